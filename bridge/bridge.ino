@@ -1,4 +1,4 @@
-#define VERSION 120
+#define VERSION 150
 #define BUFSIZE 1024
 
 // Conditions only for Arduino UNO
@@ -11,7 +11,6 @@
 //0 :5V 1:3.3V
 #define OUTPUT_power 0
 #define BAUD_RATE 57600
-#define SERIAL_READ_WAIT_US (1000000 * 10 / (BAUD_RATE) + 1)
 
 #include <SPI.h>
 
@@ -162,65 +161,261 @@ void setup() {
 
 	// _testplay();
 
+	announce();
+}
+
+void announce() {
 	Serial.print("version ");
 	Serial.println(VERSION, DEC);
+	Serial.print("buffer ");
+	Serial.println(BUFSIZE, DEC);
 	Serial.println("ready");
 }
 
 unsigned char buf[BUFSIZE];
 int bufHead = 0;
 int bufLen = 0;
-int readOnDemand = 0;
 
-int read() {
-	if (bufLen == 0) {
-		while (!Serial.available()) delayMicroseconds(SERIAL_READ_WAIT_US);
-		readOnDemand++;
-		if (6 <= readOnDemand) {
-			Serial.println("=6");
-			readOnDemand = 0;
+// Protocol v2: | 0xA5 | seq | len | payload | CRC-16 (big endian) |
+// The payload is appended to buf as the byte stream of protocol v1.
+#define FRAME_SOF 0xA5
+#define FRAME_PAYLOAD_MAX 64
+int protocol = 1;
+unsigned char expectedSeq = 0;
+int frameState = 0; // 0: SOF, 1: seq, 2: len, 3: payload, 4: CRC high, 5: CRC low
+unsigned char frameSeq, frameLen, framePos;
+unsigned int frameCrc;
+unsigned char frameBuf[FRAME_PAYLOAD_MAX];
+bool nakSent = false;
+int consumed = 0;
+
+unsigned long waitUntil = 0;
+
+// Baud rates which the host can switch to. The host confirms the new rate with a ping,
+// otherwise the sketch goes back to BAUD_RATE
+#define BAUD_RATES 6
+#define BAUD_CONFIRM_MS 2000
+const long baudRates[BAUD_RATES] = { 57600, 115200, 230400, 250000, 500000, 1000000 };
+long currentBaud = BAUD_RATE;
+bool baudPending = false;
+unsigned long baudSwitchedAt = 0;
+
+void setBaud(long rate) {
+	Serial.flush();
+	Serial.end();
+	Serial.begin(rate, SERIAL_8E1);
+	currentBaud = rate;
+}
+
+void checkBaud() {
+	if (baudPending && BAUD_CONFIRM_MS < millis() - baudSwitchedAt) {
+		baudPending = false;
+		setBaud(BAUD_RATE);
+	}
+}
+
+// Hello resets the session. It is detected in the raw input regardless of the parser state,
+// so that the host can resync even if the previous session was interrupted in the middle of a command.
+#define HELLO_SIZE 8
+const unsigned char hello[HELLO_SIZE] = { 0xFF, 0xFF, 0xFD, 'h', 'e', 'l', 'l', 'o' };
+int helloPos = 0;
+bool resetRequested = false;
+
+// Query makes the sketch announce its version again without resetting the session.
+// Older sketches execute it as waits of 1, 2 and 3 ms, so the host can send it before knowing the version
+#define QUERY_SIZE 9
+const unsigned char query[QUERY_SIZE] = { 0xFF, 0x00, 0x01, 0xFF, 0x00, 0x02, 0xFF, 0x00, 0x03 };
+int queryPos = 0;
+bool announceRequested = false;
+
+int serialRead() {
+	int b = Serial.read();
+	if (b == hello[helloPos]) {
+		helloPos++;
+		if (helloPos == HELLO_SIZE) {
+			helloPos = 0;
+			resetRequested = true;
 		}
-	return Serial.read();
+	} else if (b == 0xFF) {
+		if (helloPos != 2) helloPos = 1;
+	} else {
+		helloPos = 0;
+	}
+	if (b == query[queryPos]) {
+		queryPos++;
+		if (queryPos == QUERY_SIZE) {
+			queryPos = 0;
+			announceRequested = true;
+		}
+	} else {
+		queryPos = b == 0xFF ? 1 : 0;
+	}
+	return b;
+}
+
+// Discards all received data and restarts the session as just after setup
+void resetSession() {
+	resetRequested = false;
+	bufHead = 0;
+	bufLen = 0;
+	waitUntil = 0;
+	protocol = 1;
+	expectedSeq = 0;
+	frameState = 0;
+	nakSent = false;
+	consumed = 0;
+	while (Serial.available()) Serial.read();
+	baudPending = false;
+	if (currentBaud != BAUD_RATE) setBaud(BAUD_RATE);
+	Serial.println("hello");
+	init_825();
+	announce();
+}
+
+// CRC-16/CCITT-FALSE
+unsigned int crc16(unsigned int crc, unsigned char b) {
+	crc ^= (unsigned int)b << 8;
+	for (int i=0; i<8; i++) crc = (crc & 0x8000) ? (crc << 1) ^ 0x1021 : crc << 1;
+	return crc;
+}
+
+void nak() {
+	if (nakSent) return;
+	nakSent = true;
+	Serial.print("!");
+	Serial.println(expectedSeq, DEC);
+}
+
+void acceptFrame() {
+	if (frameSeq != expectedSeq) {
+		if ((unsigned char)(expectedSeq - frameSeq) < 128) {
+			// already received
+			Serial.print("+");
+			Serial.println((unsigned char)(expectedSeq - 1), DEC);
+		} else {
+			nak();
+		}
+		return;
+	}
+	if (BUFSIZE - bufLen < frameLen) {
+		nak();
+		return;
+	}
+	for (int i=0; i<frameLen; i++) {
+		buf[(bufHead+bufLen) % BUFSIZE] = frameBuf[i];
+		bufLen++;
+	}
+	expectedSeq++;
+	nakSent = false;
+	Serial.print("+");
+	Serial.println(frameSeq, DEC);
+}
+
+void pumpFrames() {
+	while (Serial.available() && !resetRequested) {
+		unsigned char b = serialRead();
+		switch (frameState) {
+		case 0:
+			if (b == FRAME_SOF) {
+				frameCrc = 0xFFFF;
+				frameState = 1;
+			}
+			break;
+		case 1:
+			frameSeq = b;
+			frameCrc = crc16(frameCrc, b);
+			frameState = 2;
+			break;
+		case 2:
+			frameLen = b;
+			frameCrc = crc16(frameCrc, b);
+			framePos = 0;
+			if (0 < b && b <= FRAME_PAYLOAD_MAX) {
+				frameState = 3;
+			} else {
+				frameState = 0;
+				nak();
+			}
+			break;
+		case 3:
+			frameBuf[framePos++] = b;
+			frameCrc = crc16(frameCrc, b);
+			if (framePos == frameLen) frameState = 4;
+			break;
+		case 4:
+			if (b == (frameCrc >> 8)) {
+				frameState = 5;
+			} else {
+				frameState = 0;
+				nak();
+			}
+			break;
+		case 5:
+			frameState = 0;
+			if (b == (frameCrc & 0xFF)) {
+				acceptFrame();
+			} else {
+				nak();
+			}
+			break;
+		}
+	}
+}
+
+void reportConsumed() {
+	if (0 < consumed) {
+		Serial.print("=");
+		Serial.println(consumed, DEC);
+		consumed = 0;
+	}
+}
+
+void pumpSerial() {
+	while (bufLen < BUFSIZE && Serial.available() && !resetRequested) {
+		buf[(bufHead+bufLen) % BUFSIZE] = serialRead();
+		bufLen++;
+	}
+}
+
+// Moves the received data into the ring buffer before the serial buffer of 64 bytes overflows
+void pump() {
+	if (protocol == 2) {
+		pumpFrames();
+	} else {
+		pumpSerial();
+	}
+}
+
+int read() {
+	if (resetRequested) return 0;
+	pump();
+	while (bufLen == 0) {
+		reportConsumed();
+		checkBaud();
+		pump();
+		if (resetRequested) return 0;
 	}
 	int v = buf[bufHead++];
 	bufHead %= BUFSIZE;
 	bufLen--;
+	consumed++;
+	if (32 <= consumed) reportConsumed();
 	return v;
 }
 
-unsigned long waitUntil = 0;
-bool first = true;
-
 void loop() {
-	if (first || micros() < waitUntil) {
-		int read = readOnDemand;
-		readOnDemand = 0;
-		while (bufLen < BUFSIZE && Serial.available()) {
-			buf[(bufHead+bufLen) % BUFSIZE] = Serial.read();
-			bufLen++;
-			read++;
-			if (60 <= read) {
-				Serial.print("=");
-				Serial.println(read, DEC);
-				read = 0;
-			}
-			if (first) {
-				delay(100);
-				first = false;
-			}
-		}
-		if (micros() + SERIAL_READ_WAIT_US * 3 < waitUntil) {
-			readOnDemand += read;
-			return;
-		}
-		if (0 < read) {
-			Serial.print("=");
-			Serial.println(read, DEC);
-			// if (9 < bufLen) {
-			// 	Serial.print("#B");
-			// 	Serial.println(bufLen, DEC);
-			// }
-		}
+	if (resetRequested) {
+		resetSession();
+		return;
+	}
+	if (announceRequested) {
+		announceRequested = false;
+		announce();
+	}
+	checkBaud();
+	pump();
+	if (micros() < waitUntil || bufLen == 0) {
+		reportConsumed();
 		return;
 	}
 
@@ -235,9 +430,46 @@ void loop() {
 	if (addr == 0x7F) {
 		if (size == 0xFFFF) {
 			// Serial.print("#T");
-			while (Serial.available()) Serial.read();
-			Serial.end();
+			resetRequested = true;
 			return;
+		} else if (size == 0xFFFE) {
+			// Switch to protocol v2
+			protocol = 2;
+			expectedSeq = 0;
+			frameState = 0;
+			nakSent = false;
+			consumed = 0;
+			Serial.println("protocol 2");
+		} else if (size == 0xFFFC) {
+			// Query baud rates
+			Serial.print("bauds");
+			for (int i=0; i<BAUD_RATES; i++) {
+				Serial.print(" ");
+				Serial.print(baudRates[i], DEC);
+			}
+			Serial.println();
+		} else if (size == 0xFFFB) {
+			// Ping
+			baudPending = false;
+			reportConsumed();
+			Serial.println("pong");
+		} else if ((size & 0xFF00) == 0x8100) {
+			// Switch baud rate
+			int i = size & 0xFF;
+			if (i < BAUD_RATES) {
+				reportConsumed();
+				Serial.print("baud ");
+				Serial.println(baudRates[i], DEC);
+				setBaud(baudRates[i]);
+				baudPending = true;
+				baudSwitchedAt = millis();
+			}
+		} else if ((size & 0xFF80) == 0x8000) {
+			// Read register
+			Serial.print("reg ");
+			Serial.print(size & 0x7F, DEC);
+			Serial.print(" ");
+			Serial.println(if_s_read(size & 0x7F), DEC);
 		} else {
 			// Serial.print("#W");
 			// Serial.println(size, DEC);
@@ -246,7 +478,7 @@ void loop() {
 	} else {
 		set_ss_pin(LOW);
 		SPI.transfer(addr);
-		while (0 < size--) SPI.transfer(read());
+		while (0 < size-- && !resetRequested) SPI.transfer(read());
 		set_ss_pin(HIGH);
 	}
 }
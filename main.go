@@ -30,9 +30,23 @@ func main() {
 	}
 	app.HelpName = "smaf825"
 
+	app.Flags = []cli.Flag{
+		cli.Float64Flag{
+			Name:  "tune, t",
+			Usage: `Frequency of A4 in Hz (220..880). stream applies it on top of the tuning given to compile`,
+			Value: 440,
+		},
+	}
+
 	app.Commands = []cli.Command{
 		subcmd.Dump,
 		subcmd.Play,
+		subcmd.Compile,
+		subcmd.Stream,
+		subcmd.DecodeStream,
+		subcmd.Selftest,
+		subcmd.Ports,
+		subcmd.VoiceLib,
 	}
 
 	app.Action = func(ctx *cli.Context) error {
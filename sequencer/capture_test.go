@@ -0,0 +1,70 @@
+package sequencer
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/but80/smaf825/smaf/chunk"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// TestCapture plays a small song to a file: device and compares the captured bytes and times with the golden files
+func TestCapture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smaf825")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mmf, err := chunk.NewFileChunk(filepath.Join("testdata", "scale.mmf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "scale.bin")
+	q := Sequencer{DeviceName: "file:" + out}
+	opts := &SequencerOptions{
+		Loop:     1,
+		Volume:   48,
+		Gain:     1,
+		SeqVol:   16,
+		BaudRate: 57600,
+		Tune:     440,
+		Speed:    1,
+	}
+	if err := q.Open(opts.BaudRate); err != nil {
+		t.Fatal(err)
+	}
+	err = q.Play(mmf, opts)
+	if err2 := q.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"scale.bin", "scale.bin.times"} {
+		got, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		golden := filepath.Join("testdata", name)
+		if *update {
+			if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s differs from the golden file (run go test -update to regenerate it)", name)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package sequencer
+
+import (
+	"github.com/but80/smaf825/smaf/chunk"
+	"github.com/but80/smaf825/smaf/enums"
+	"github.com/pkg/errors"
+)
+
+// Pause silences all voices and holds playback until Resume is called
+func (q *Sequencer) Pause() {
+	// The port is called without the lock, since it may block while its flusher is writing to the device
+	q.mutex.Lock()
+	port := q.port
+	if q.paused || port == nil {
+		q.mutex.Unlock()
+		return
+	}
+	q.paused = true
+	q.mutex.Unlock()
+	port.Pause()
+}
+
+// Resume restarts playback paused by Pause
+func (q *Sequencer) Resume() {
+	q.mutex.Lock()
+	port := q.port
+	if !q.paused || port == nil {
+		q.mutex.Unlock()
+		return
+	}
+	q.paused = false
+	q.mutex.Unlock()
+	port.Resume()
+}
+
+func (q *Sequencer) IsPaused() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.paused
+}
+
+// ErrStopped is returned by Play when playback is stopped by Stop
+var ErrStopped = errors.New("Stopped")
+
+// Stop stops playback. Play returns ErrStopped after all voices are turned off.
+// If Stop is called while not playing, the next Play returns ErrStopped without playing
+func (q *Sequencer) Stop() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.stopped = true
+}
+
+// hasPendingControl returns true if any control request should be handled by the playing loop
+func (q *Sequencer) hasPendingControl() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.stopped || q.paused || q.seekRequest != nil || q.muteChanged
+}
+
+// takeStopped returns ErrStopped and clears the request if Stop has been called
+func (q *Sequencer) takeStopped() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if !q.stopped {
+		return nil
+	}
+	q.stopped = false
+	return ErrStopped
+}
+
+func (q *Sequencer) isStopped() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.stopped
+}
+
+// 0<=v<64
+func (q *Sequencer) SetMasterVolume(v int) {
+	if v < 0 {
+		v = 0
+	} else if 63 < v {
+		v = 63
+	}
+	q.mutex.Lock()
+	q.volume = v
+	port := q.port
+	q.mutex.Unlock()
+	if port != nil {
+		port.SendMasterVolume(v)
+	}
+}
+
+func (q *Sequencer) MasterVolume() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.volume
+}
+
+func (q *Sequencer) ToggleMute(ch enums.Channel) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.muted[ch&15] = !q.muted[ch&15]
+	q.muteChanged = true
+}
+
+func (q *Sequencer) ToggleSolo(ch enums.Channel) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.soloed[ch&15] = !q.soloed[ch&15]
+	q.muteChanged = true
+}
+
+// IsAudible returns false if the channel is muted or another channel is soloed
+func (q *Sequencer) IsAudible(ch enums.Channel) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.isAudible(ch)
+}
+
+func (q *Sequencer) isAudible(ch enums.Channel) bool {
+	for _, solo := range q.soloed {
+		if solo {
+			return q.soloed[ch&15]
+		}
+	}
+	return !q.muted[ch&15]
+}
+
+// releaseInaudible sends KeyOff for notes of the channels muted after the last call
+func (q *Sequencer) releaseInaudible(sequence *chunk.ScoreTrackSequenceDataChunk) {
+	q.mutex.Lock()
+	changed := q.muteChanged
+	q.muteChanged = false
+	q.mutex.Unlock()
+	if !changed {
+		return
+	}
+	for ch, cs := range State.Channels {
+		if !q.IsAudible(enums.Channel(ch)) {
+			q.sendKeyOff(sequence, enums.Channel(ch), cs.AllOff())
+		}
+	}
+}
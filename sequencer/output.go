@@ -0,0 +1,36 @@
+package sequencer
+
+import (
+	"github.com/but80/smaf825/serial"
+	"github.com/but80/smaf825/smaf/enums"
+	"github.com/but80/smaf825/smaf/voice"
+)
+
+// output is the destination of the commands, i.e. *serial.SerialPort or *serial.PortGroup
+type output interface {
+	Voices() int
+	Flush() bool
+	Pause()
+	Resume()
+	Metrics() serial.Metrics
+	Err() <-chan error
+	Close() error
+	Reconnect() error
+	SendWait(msec int)
+	SendAllOff()
+	SendMasterVolume(v int)
+	SendAnalogGain(g int)
+	SendSeqVol(v int)
+	SendTones(data []*voice.VM35FMVoice)
+	SendVibrato(ch, vib int)
+	SendVolume(ch, ChVol int, DIR_CV bool)
+	SendFineTuneByFloat(ch int, r float64)
+	SendKeyOn(ch int, note enums.Note, delta float64, VoVol, ToneNum int)
+	SendPitch(ch int, note enums.Note, delta float64)
+	SendKeyOff(ch, ToneNum int)
+}
+
+var (
+	_ output = &serial.SerialPort{}
+	_ output = &serial.PortGroup{}
+)
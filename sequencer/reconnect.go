@@ -0,0 +1,72 @@
+package sequencer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/but80/smaf825/smaf/chunk"
+	"github.com/but80/smaf825/smaf/enums"
+	"github.com/but80/smaf825/smaf/log"
+)
+
+// ReconnectMode decides what the sequencer does when the connection to the device is lost
+type ReconnectMode int
+
+const (
+	// ReconnectNone stops playback with the error
+	ReconnectNone ReconnectMode = iota
+	// ReconnectPause holds the song until the device is reconnected
+	ReconnectPause
+	// ReconnectContinue keeps the song running, so that the device resumes from the current position
+	ReconnectContinue
+)
+
+// reconnectInterval is the interval between the attempts to reopen the device
+const reconnectInterval = time.Second
+
+// ParseReconnectMode parses "none", "pause" or "continue"
+func ParseReconnectMode(s string) (ReconnectMode, error) {
+	switch s {
+	case "", "none":
+		return ReconnectNone, nil
+	case "pause":
+		return ReconnectPause, nil
+	case "continue":
+		return ReconnectContinue, nil
+	}
+	return ReconnectNone, fmt.Errorf("Invalid reconnect mode: %s", s)
+}
+
+// reconnect reopens the device until it succeeds. It returns false if playback is stopped while waiting
+func (q *Sequencer) reconnect(err error) bool {
+	log.Warnf("Lost the connection to the device: %s", err.Error())
+	for !q.isStopped() {
+		err := q.port.Reconnect()
+		if err == nil {
+			log.Infof("reconnected")
+			q.portErr = nil
+			return true
+		}
+		log.Debugf("cannot reconnect: %s", err.Error())
+		time.Sleep(reconnectInterval)
+	}
+	return false
+}
+
+// restore sends the whole state to the device which has been reset, including the notes being held
+func (q *Sequencer) restore(sequence *chunk.ScoreTrackSequenceDataChunk, opts *SequencerOptions) {
+	q.port.SendMasterVolume(q.MasterVolume())
+	q.port.SendAnalogGain(opts.Gain)
+	q.port.SendSeqVol(opts.SeqVol)
+	q.sendTones()
+	q.initVoices(sequence)
+	q.sendChannelStates(sequence)
+	for ch, cs := range State.Channels {
+		if !q.IsAudible(enums.Channel(ch)) {
+			continue
+		}
+		for note := range cs.NoteOffTime {
+			q.sendKeyOn(sequence, enums.Channel(ch), note)
+		}
+	}
+}
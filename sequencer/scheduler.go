@@ -0,0 +1,114 @@
+package sequencer
+
+import (
+	"time"
+
+	"github.com/but80/smaf825/smaf/log"
+)
+
+// lookAhead is how far the host may run ahead of the device
+const lookAhead = 200 * time.Millisecond
+
+// stutterWarnInterval limits the warnings about the commands behind schedule
+const stutterWarnInterval = 5 * time.Second
+
+// scheduler converts absolute song time into the waits sent to the device.
+// The device timing depends only on the waits, so host jitter does not accumulate.
+// The host is paced to stay at most lookAhead in front of the device.
+type scheduler struct {
+	port      output
+	speed     float64
+	wallStart time.Time // wall clock time when the device is expected to play song time 0
+	sent      int       // song time up to which the waits are sent (msec)
+	waitRest  float64   // fraction of the wait not sent yet (msec in device time)
+	paused    bool
+	paced     bool // false if the commands are generated as fast as possible
+	warnedAt  time.Time
+}
+
+func newScheduler(port output, speed float64, paced bool) *scheduler {
+	return &scheduler{
+		port:  port,
+		speed: speed,
+		paced: paced,
+	}
+}
+
+// start sends the preroll wait before song time 0
+func (s *scheduler) start(preroll int) {
+	s.port.SendWait(preroll)
+	s.wallStart = time.Now().Add(time.Duration(preroll) * time.Millisecond)
+}
+
+func (s *scheduler) wallTime(t int) time.Time {
+	return s.wallStart.Add(time.Duration(float64(t) / s.speed * float64(time.Millisecond)))
+}
+
+// advanceTo blocks until the host may send the commands at song time t, then sends a wait for the gap.
+// It returns false without sending anything if interrupted returns true while waiting.
+func (s *scheduler) advanceTo(t int, interrupted func() bool) bool {
+	if t <= s.sent {
+		return true
+	}
+	target := s.wallTime(t).Add(-lookAhead)
+	for s.paced {
+		d := time.Until(target)
+		if d <= 0 {
+			break
+		}
+		if interrupted() {
+			return false
+		}
+		if 10*time.Millisecond < d {
+			d = 10 * time.Millisecond
+		}
+		time.Sleep(d)
+	}
+	s.waitRest += float64(t-s.sent) / s.speed
+	wait := int(s.waitRest)
+	s.waitRest -= float64(wait)
+	if 0 < wait {
+		s.port.SendWait(wait)
+	}
+	s.sent = t
+	if s.paced {
+		s.checkLag()
+	}
+	return true
+}
+
+// checkLag warns if the commands are queued longer than lookAhead, which means the device plays them late
+func (s *scheduler) checkLag() {
+	m := s.port.Metrics()
+	if m.Lag < lookAhead || time.Since(s.warnedAt) < stutterWarnInterval {
+		return
+	}
+	s.warnedAt = time.Now()
+	log.Warnf("Playback may stutter: commands are %v behind schedule with %d bytes queued. Try a higher baud rate", m.Lag.Round(time.Millisecond), m.Queued)
+}
+
+// now returns the song time which the device should be playing now
+func (s *scheduler) now() int {
+	return int(float64(time.Since(s.wallStart)) * s.speed / float64(time.Millisecond))
+}
+
+// skipTo makes the device continue from song time t without waiting for the gap
+func (s *scheduler) skipTo(t int) {
+	if s.sent < t {
+		s.sent = t
+		s.waitRest = 0
+	}
+}
+
+func (s *scheduler) pause() {
+	s.paused = true
+}
+
+// resume lets the device restart from the song time already sent
+func (s *scheduler) resume() {
+	if !s.paused {
+		return
+	}
+	s.paused = false
+	s.wallStart = time.Now().Add(-time.Duration(float64(s.sent) / s.speed * float64(time.Millisecond)))
+}
@@ -0,0 +1,123 @@
+package sequencer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/but80/smaf825/smaf/chunk"
+	"github.com/but80/smaf825/smaf/enums"
+)
+
+// Position points a playback position in milliseconds or by event index
+type Position struct {
+	Msec  int
+	Event int // -1 if Msec is used
+}
+
+// ParsePosition parses a position given as "12345" (msec), "mm:ss[.sss]" or "#index" (event index)
+func ParsePosition(s string) (*Position, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "#") {
+		i, err := strconv.Atoi(s[1:])
+		if err != nil || i < 0 {
+			return nil, fmt.Errorf("Invalid event index: %s", s)
+		}
+		return &Position{Event: i}, nil
+	}
+	if i := strings.Index(s, ":"); 0 <= i {
+		m, err := strconv.Atoi(s[:i])
+		if err != nil || m < 0 {
+			return nil, fmt.Errorf("Invalid position: %s", s)
+		}
+		sec, err := strconv.ParseFloat(s[i+1:], 64)
+		if err != nil || sec < 0 || 60 <= sec {
+			return nil, fmt.Errorf("Invalid position: %s", s)
+		}
+		return &Position{Msec: m*60000 + int(sec*1000+.5), Event: -1}, nil
+	}
+	msec, err := strconv.Atoi(strings.TrimSuffix(s, "ms"))
+	if err != nil || msec < 0 {
+		return nil, fmt.Errorf("Invalid position: %s", s)
+	}
+	return &Position{Msec: msec, Event: -1}, nil
+}
+
+func (p *Position) String() string {
+	if 0 <= p.Event {
+		return fmt.Sprintf("#%d", p.Event)
+	}
+	return fmt.Sprintf("%d:%06.3f", p.Msec/60000, float64(p.Msec%60000)/1000.0)
+}
+
+// Seek requests the playing sequence to jump to the given position
+func (q *Sequencer) Seek(pos Position) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.seekRequest = &pos
+}
+
+// CurrentMsec returns the current playback position in milliseconds
+func (q *Sequencer) CurrentMsec() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.position
+}
+
+func (q *Sequencer) takeSeekRequest() *Position {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	pos := q.seekRequest
+	q.seekRequest = nil
+	return pos
+}
+
+func (q *Sequencer) setPosition(msec int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.position = msec
+}
+
+// locate returns the index of the first event to be played from the position and the time of the position
+func locate(timeline *chunk.Timeline, pos *Position) (int, int) {
+	events := timeline.Events
+	if 0 <= pos.Event {
+		if len(events) <= pos.Event {
+			if len(events) == 0 {
+				return 0, 0
+			}
+			return len(events), events[len(events)-1].Msec
+		}
+		return pos.Event, events[pos.Event].Msec
+	}
+	return timeline.Search(pos.Msec), pos.Msec
+}
+
+// releaseAll sends KeyOff for all notes being played
+func (q *Sequencer) releaseAll(sequence *chunk.ScoreTrackSequenceDataChunk) {
+	for ch, cs := range State.Channels {
+		q.sendKeyOff(sequence, enums.Channel(ch), cs.AllOff())
+	}
+}
+
+// chase replays all events before the index without sounding notes,
+// then sends the resulting channel state
+func (q *Sequencer) chase(sequence *chunk.ScoreTrackSequenceDataChunk, gateTimeBase, index int) {
+	q.chasing = true
+	for i := 0; i < index && i < len(sequence.Events); i++ {
+		q.processEvent(sequence, gateTimeBase, 0, sequence.Events[i].Event)
+	}
+	q.chasing = false
+	q.sendChannelStates(sequence)
+}
+
+// sendChannelStates sends the volume, the vibrato and the tuning of all channels
+func (q *Sequencer) sendChannelStates(sequence *chunk.ScoreTrackSequenceDataChunk) {
+	for ch, cs := range State.Channels {
+		for _, chTo := range sequence.ChannelsTo(enums.Channel(ch)) {
+			q.port.SendVolume(chTo, scale127(cs.Volume, 31, 1.0), true)
+			q.port.SendVibrato(chTo, scale127(cs.Modulation, 7, 1.0))
+		}
+		q.sendFineTune(sequence, enums.Channel(ch))
+	}
+}
@@ -1,6 +1,7 @@
 package sequencer
 
 import (
+	"context"
 	"time"
 
 	"fmt"
@@ -9,12 +10,13 @@ import (
 
 	"strings"
 
+	"sync"
+
 	"github.com/but80/smaf825/serial"
 	"github.com/but80/smaf825/smaf/chunk"
 	"github.com/but80/smaf825/smaf/enums"
 	"github.com/but80/smaf825/smaf/event"
 	"github.com/but80/smaf825/smaf/log"
-	"github.com/but80/smaf825/smaf/util"
 	"github.com/but80/smaf825/smaf/voice"
 	"github.com/pkg/errors"
 	"github.com/xlab/closer"
@@ -35,12 +37,40 @@ $ hexdump -C < /dev/ttys007
 
 type SequencerOptions struct {
 	Loop, Volume, Gain, SeqVol, BaudRate int
+	Tune, Speed                          float64
+	Transpose                            int
+	From, To                             *Position
+	Mute, Solo                           []enums.Channel
+	ChannelMap                           map[enums.Channel]int
 }
 
 type Sequencer struct {
 	DeviceName string
-	ShowState  bool
-	port       *serial.SerialPort
+	// Devices are the devices driven as one if more than one are given, instead of DeviceName
+	Devices []string
+	// Pan plays the notes by the first (left) or the last (right) of Devices by the panpot of their channels
+	Pan bool
+	// Reconnect decides what to do when the connection to the device is lost
+	Reconnect ReconnectMode
+	portErr   error
+	ShowState bool
+	// Router decides voices to which the notes are assigned. DrumSplitRouter is used if nil
+	Router      chunk.ChannelRouter
+	port        output
+	tuneRatio   float64
+	transpose   int
+	chasing     bool
+	compiling   bool
+	position    int
+	seekRequest *Position
+	paused      bool
+	stopped     bool
+	volume      int
+	muted       [16]bool
+	soloed      [16]bool
+	muteChanged bool
+	mutex       sync.Mutex
+	bindOnce    sync.Once
 }
 
 type DebugFlags struct {
@@ -57,8 +87,102 @@ var debugFlags = &DebugFlags{
 	KeyControl: false,
 }
 
+// Open opens the serial port if not opened yet. The port is kept open across calls of Play
+func (q *Sequencer) Open(baudRate int) error {
+	if q.port != nil {
+		return nil
+	}
+	q.bindOnce.Do(func() {
+		closer.Bind(q.interrupt)
+	})
+	if 1 < len(q.Devices) {
+		group, err := serial.NewPortGroup(q.Devices, baudRate)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		group.Start(context.Background())
+		q.port = group
+		return nil
+	}
+	deviceName := q.DeviceName
+	if len(q.Devices) == 1 {
+		deviceName = q.Devices[0]
+	}
+	port, err := serial.NewSerialPort(deviceName, baudRate)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	port.Start(context.Background())
+	q.port = port
+	return nil
+}
+
+// Close closes the serial port opened by Open
+func (q *Sequencer) Close() error {
+	if q.port == nil {
+		return nil
+	}
+	err := q.port.Close()
+	q.port = nil
+	return err
+}
+
+// interruptFlushTimeout is how long interrupt waits for the device, which may not respond anymore
+const interruptFlushTimeout = time.Second
+
+// interrupt stops playback, silences the device and closes it when the process is terminated
+func (q *Sequencer) interrupt() {
+	q.Stop()
+	if q.port == nil {
+		return
+	}
+	q.port.SendAllOff()
+	deadline := time.Now().Add(interruptFlushTimeout)
+	for !q.port.Flush() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	q.Close()
+}
+
+// PortError returns the error occurred in the serial port, if any. The port does not work after the error
+func (q *Sequencer) PortError() error {
+	if q.portErr != nil || q.port == nil {
+		return q.portErr
+	}
+	select {
+	case q.portErr = <-q.port.Err():
+	default:
+	}
+	return q.portErr
+}
+
+// Compile generates the commands which Play sends to the device, without waiting for the playback time
+func (q *Sequencer) Compile(mmf *chunk.FileChunk, opts *SequencerOptions) (*serial.Stream, error) {
+	if opts.Loop < 1 {
+		return nil, fmt.Errorf("Cannot compile infinite loop")
+	}
+	port := q.port
+	recorder := serial.NewRecorder()
+	q.port = recorder
+	q.compiling = true
+	defer func() {
+		q.port = port
+		q.compiling = false
+	}()
+	err := q.Play(mmf, opts)
+	if err != nil {
+		return nil, err
+	}
+	return serial.NewStream(opts.Volume, opts.Gain, opts.SeqVol, recorder.Recorded()), nil
+}
+
 func (q *Sequencer) Play(mmf *chunk.FileChunk, opts *SequencerOptions) error {
+	// A stop requested before playing, e.g. between songs, skips this song
+	if err := q.takeStopped(); err != nil {
+		return err
+	}
 	var err error
+	State.Reset()
 	var info *chunk.ContentsInfoChunk
 	var data *chunk.DataChunk
 	var setup chunk.ExclusiveContainer
@@ -127,13 +251,38 @@ func (q *Sequencer) Play(mmf *chunk.FileChunk, opts *SequencerOptions) error {
 				st.KeyControlStatus = enums.KeyControlStatus_On
 			}
 			State.Channels[ch].KeyControlStatus = st.KeyControlStatus
+			State.Channels[ch].ChannelType = st.ChannelType
 			if st.KeyControlStatus == enums.KeyControlStatus_Off {
 				channelsToSplit = append(channelsToSplit, ch)
 			}
 		}
 	}
 	sequence := chunk.MergeSequenceDataChunks(sequences)
+	err = q.Open(opts.BaudRate)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	sequence.Router = q.Router
+	switch {
+	case sequence.Router != nil:
+	case serial.VoicesPerPort < q.port.Voices():
+		// Several devices share their voices by all channels
+		sequence.Router = &chunk.PoolRouter{Voices: q.port.Voices(), Pan: q.Pan, Map: opts.ChannelMap}
+	default:
+		sequence.Router = &chunk.DrumSplitRouter{Voices: q.port.Voices()}
+	}
+	if _, ok := sequence.Router.(chunk.NoteAllocator); !ok && 0 < len(opts.ChannelMap) {
+		sequence.Router = &chunk.ChannelMapRouter{Base: sequence.Router, Map: opts.ChannelMap}
+	}
 	sequence.AggregateUsage(channelsToSplit)
+	q.muted = [16]bool{}
+	q.soloed = [16]bool{}
+	for _, ch := range opts.Mute {
+		q.muted[ch&15] = true
+	}
+	for _, ch := range opts.Solo {
+		q.soloed[ch&15] = true
+	}
 	//
 	log.Debugf("collecting voices")
 	for _, x := range setup.GetExclusives() {
@@ -151,16 +300,170 @@ func (q *Sequencer) Play(mmf *chunk.FileChunk, opts *SequencerOptions) error {
 		}
 	}
 	//
-	if q.port == nil {
-		q.port, err = serial.NewSerialPort(q.DeviceName, opts.BaudRate)
-		if err != nil {
-			return errors.WithStack(err)
-		}
+	if q.compiling {
+		// The initial settings are stored in the stream header
+		q.volume = opts.Volume
+	} else {
+		q.SetMasterVolume(opts.Volume)
+		q.port.SendAnalogGain(opts.Gain)
+		q.port.SendSeqVol(opts.SeqVol)
+	}
+	//
+	q.sendTones()
+	//
+	q.tuneRatio = 1.0
+	if 0 < opts.Tune {
+		q.tuneRatio = opts.Tune / 440.0
 	}
-	q.port.SendMasterVolume(opts.Volume)
-	q.port.SendAnalogGain(opts.Gain)
-	q.port.SendSeqVol(opts.SeqVol)
+	q.initVoices(sequence)
 	//
+	durationTimeBase, gateTimeBase := 20, 20
+	if score != nil {
+		durationTimeBase = score.DurationTimeBase
+		gateTimeBase = score.GateTimeBase
+	}
+	log.Debugf("durationTimeBase = %d msec", durationTimeBase)
+	log.Debugf("gateTimeBase = %d msec", gateTimeBase)
+	speed := opts.Speed
+	if speed <= 0 {
+		speed = 1.0
+	}
+	q.transpose = opts.Transpose
+	timeline := chunk.NewSequenceTimeline(sequence, durationTimeBase, gateTimeBase)
+	events := timeline.Events
+	fromIndex, fromMsec := 0, 0
+	if opts.From != nil {
+		fromIndex, fromMsec = locate(timeline, opts.From)
+	}
+	endIndex, endMsec := len(sequence.Events), -1
+	if opts.To != nil {
+		endIndex, endMsec = locate(timeline, opts.To)
+	}
+	if endIndex <= fromIndex || (0 <= endMsec && endMsec <= fromMsec) {
+		return fmt.Errorf("Empty playback range")
+	}
+	sched := newScheduler(q.port, speed, !q.compiling)
+	loop := opts.Loop
+	iEvent := 0
+	// elapsed is the song time since the start, which never goes back even when seeking or looping.
+	// segBase and segPos are elapsed and the position at the last seek.
+	elapsed, segBase, segPos := 0, 0, 0
+	toElapsed := func(pos int) int {
+		return segBase + pos - segPos
+	}
+	seek := func(index, msec int, hard bool) {
+		if hard {
+			q.releaseAll(sequence)
+			State.ResetChannels()
+		}
+		if hard || 0 < index {
+			q.chase(sequence, gateTimeBase, index)
+		}
+		iEvent = index
+		segBase, segPos = elapsed, msec
+		q.setPosition(msec)
+	}
+	sched.start(1000)
+	if opts.From != nil {
+		seek(fromIndex, fromMsec, true)
+	}
+	// skip follows the events until song time t without sounding them, when the device was lost while the song runs
+	skip := func(t int) {
+		q.chasing = true
+		for iEvent < endIndex && toElapsed(events[iEvent].Msec) <= t {
+			q.processEvent(sequence, gateTimeBase, toElapsed(events[iEvent].Msec), events[iEvent].Event)
+			iEvent++
+		}
+		q.chasing = false
+		State.Expire(t, func(ch int, notes []enums.Note) {})
+		elapsed = t
+		sched.skipTo(t)
+		q.setPosition(segPos + elapsed - segBase)
+	}
+	for !q.isStopped() {
+		if err := q.PortError(); err != nil {
+			if q.Reconnect == ReconnectNone {
+				return err
+			}
+			if q.Reconnect == ReconnectPause {
+				sched.pause()
+			}
+			if !q.reconnect(err) {
+				break
+			}
+			if q.Reconnect == ReconnectContinue {
+				skip(sched.now())
+			}
+			q.restore(sequence, opts)
+			continue
+		}
+		if q.IsPaused() {
+			sched.pause()
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		sched.resume()
+		q.releaseInaudible(sequence)
+		if pos := q.takeSeekRequest(); pos != nil {
+			index, msec := locate(timeline, pos)
+			seek(index, msec, true)
+		}
+		if endMsec < 0 && endIndex <= iEvent {
+			if loop != 1 {
+				loop--
+				seek(fromIndex, fromMsec, false)
+				continue
+			}
+		}
+		// The next time when any register write occurs
+		t := -1
+		if iEvent < endIndex {
+			t = toElapsed(events[iEvent].Msec)
+		}
+		if off, ok := State.NextNoteOff(); ok && (t < 0 || off < t) {
+			t = off
+		}
+		if 0 <= endMsec && (t < 0 || toElapsed(endMsec) < t) {
+			t = toElapsed(endMsec)
+		}
+		if t < 0 {
+			break
+		}
+		if !sched.advanceTo(t, q.hasPendingControl) {
+			continue
+		}
+		elapsed = t
+		q.setPosition(segPos + elapsed - segBase)
+		State.Expire(elapsed, func(ch int, notes []enums.Note) {
+			q.sendKeyOff(sequence, enums.Channel(ch), notes)
+		})
+		for iEvent < endIndex && toElapsed(events[iEvent].Msec) <= elapsed {
+			q.processEvent(sequence, gateTimeBase, elapsed, events[iEvent].Event)
+			iEvent++
+		}
+		if q.ShowState {
+			State.Print()
+		}
+		if 0 <= endMsec && endMsec <= segPos+elapsed-segBase {
+			if loop == 1 {
+				break
+			}
+			loop--
+			seek(fromIndex, fromMsec, false)
+		}
+	}
+	q.port.SendAllOff()
+	for !q.port.Flush() {
+		time.Sleep(time.Millisecond)
+	}
+	log.Debugf("%s", q.port.Metrics())
+	if err := q.PortError(); err != nil {
+		return err
+	}
+	return q.takeStopped()
+}
+
+func (q *Sequencer) sendTones() {
 	log.Debugf("sending voices")
 	q.port.SendAllOff() // トーン設定時は発音をすべて停止
 	if debugFlags.Tone {
@@ -170,92 +473,26 @@ func (q *Sequencer) Play(mmf *chunk.FileChunk, opts *SequencerOptions) error {
 	} else {
 		q.port.SendTones(State.ToneData())
 	}
-	//
-	var timeBase, durationTickCycle, gateTickCycle int
-	if score == nil {
-		timeBase = 20
-		durationTickCycle = 1
-		gateTickCycle = 1
-	} else {
-		timeBase = util.GCD(score.DurationTimeBase, score.GateTimeBase)
-		durationTickCycle = score.DurationTimeBase / timeBase
-		gateTickCycle = score.GateTimeBase / timeBase
-	}
-	log.Debugf("common time base = %d msec", timeBase)
-	log.Debugf("durationTickCycle = %d", durationTickCycle)
-	log.Debugf("gateTickCycle = %d", gateTickCycle)
-	ticker := time.NewTicker(time.Duration(timeBase)*time.Millisecond - time.Millisecond)
-	end := make(chan bool)
-	stopped := false
-	closer.Bind(func() {
-		stopped = true
-		q.port.SendAllOff()
-	})
-	go func() {
-		loop := opts.Loop
-		iEvent := 0
-		durationRest := 0
-		q.port.SendWait(1000)
-		var pendingEvent event.Event
-		for !stopped && (iEvent < len(sequence.Events) || State.HasRest()) {
-			q.port.SendWait(timeBase)
-			select {
-			case <-ticker.C:
-				keyOffFound := false
-				State.Tick(func(ch int, notes []enums.Note) {
-					cs := State.Channels[ch]
-					for _, note := range notes {
-						chTo := sequence.ChannelTo(enums.Channel(ch), note)
-						toneID := cs.ToneID
-						if cs.KeyControlStatus == enums.KeyControlStatus_Off {
-							toneID = State.GetToneIDByPCAndDrumNote(cs.BankMSB, cs.BankLSB, cs.PC, note)
-						}
-						q.port.SendKeyOff(chTo, toneID)
-					}
-					keyOffFound = true
-				})
-				durationRest--
-				if 0 < durationRest {
-					if keyOffFound && q.ShowState {
-						State.Print()
-					}
-					continue
-				}
-				if pendingEvent != nil {
-					q.processEvent(sequence, gateTickCycle, pendingEvent)
-					pendingEvent = nil
-				}
-				for iEvent < len(sequence.Events) {
-					pair := sequence.Events[iEvent]
-					iEvent++
-					if len(sequence.Events) <= iEvent && loop != 1 {
-						loop--
-						iEvent = 0
-					}
-					if 0 < pair.Duration {
-						if q.ShowState {
-							State.Print()
-						}
-						//if 128 <= pair.Duration {
-						//	log.Debugf("dur %d", pair.Duration)
-						//}
-						durationRest = pair.Duration * durationTickCycle
-						pendingEvent = pair.Event
-						break
-					}
-					q.processEvent(sequence, gateTickCycle, pair.Event)
-				}
-			}
-		}
-		end <- true
-	}()
-	<-end
-	ticker.Stop()
-	q.port.SendAllOff()
-	for !q.port.Flush() {
-		time.Sleep(time.Millisecond)
+}
+
+// initVoices sends the initial state to all voices
+func (q *Sequencer) initVoices(sequence *chunk.ScoreTrackSequenceDataChunk) {
+	for v := 0; v < q.port.Voices(); v++ {
+		// All channels are in the initial state here
+		cs := State.Channels[v%len(State.Channels)]
+		q.port.SendVolume(v, scale127(cs.Volume, 31, 1.0), true)
+		q.port.SendVibrato(v, 0)
+		q.port.SendFineTuneByFloat(v, q.tuneRatio)
+	}
+	for ch, cs := range State.Channels {
+		q.setPan(sequence, enums.Channel(ch), cs.Panpot)
 	}
-	return nil
+}
+
+// allocator returns the router of the sequence if it assigns the voices while playing
+func allocator(sequence *chunk.ScoreTrackSequenceDataChunk) chunk.NoteAllocator {
+	alloc, _ := sequence.Router.(chunk.NoteAllocator)
+	return alloc
 }
 
 func scale127(v, max int, curve float64) int {
@@ -264,55 +501,36 @@ func scale127(v, max int, curve float64) int {
 	return int(math.Floor(.5 + float64(max)*r))
 }
 
-func (q *Sequencer) processEvent(sequence *chunk.ScoreTrackSequenceDataChunk, gateTickCycle int, e event.Event) {
+func (q *Sequencer) processEvent(sequence *chunk.ScoreTrackSequenceDataChunk, gateTimeBase, now int, e event.Event) {
 	ch := e.GetChannel()
 	cs := State.Channels[ch]
 	switch evt := e.(type) {
 
 	case *event.NoteEvent:
-		cs.Velocity = evt.Velocity
-		cs.NoteOn(evt.Note, evt.GateTime*gateTickCycle) // @todo Add "+1" for tie/slur only
-		vel := float64(cs.Velocity) / 127.0
-		exp := float64(cs.Expression) / 127.0
-		var vol float64
-		if State.IsMA5 {
-			vol = vel + exp - 1.0
-			if vol < .0 {
-				vol = .0
-			}
-		} else {
-			vol = (vel + exp) * .5
-			if vel == .0 || exp == .0 {
-				vol = .0
-			}
+		if q.chasing || !q.IsAudible(ch) {
+			break
 		}
-		if debugFlags.Volume {
-			vol = 1.0
-		}
-		delta := float64(cs.PitchBend) * float64(cs.PitchBendRange) / 8192.0
-		note := evt.Note
-		toneID := cs.ToneID
-		chTo := sequence.ChannelTo(ch, note)
-		if cs.KeyControlStatus == enums.KeyControlStatus_Off {
-			toneID = State.GetToneIDByPCAndDrumNote(cs.BankMSB, cs.BankLSB, cs.PC, note)
-			if 0 <= toneID {
-				note = State.Tones[toneID].Voice.(*voice.VM35FMVoice).DrumKey
-			}
-		}
-		if debugFlags.Tone {
-			toneID = 0
+		cs.Velocity = evt.Velocity
+		noteOff := now + evt.GateTime*gateTimeBase // @todo Add 1 step for tie/slur only
+		if evt.GateTime == 0 {
+			noteOff = -1
 		}
-		if 0 <= toneID {
-			q.port.SendKeyOn(chTo, note+enums.Note(cs.OctaveShift*12), delta, int(math.Floor(.5+31.0*vol)), toneID)
+		alloc := allocator(sequence)
+		poly := alloc != nil && !cs.Mono && alloc.Polyphonic(ch)
+		dropped := cs.NoteOn(evt.Note, noteOff, poly)
+		if alloc != nil {
+			// The dropped notes may hold other voices than the new note
+			q.sendKeyOff(sequence, ch, dropped)
 		}
+		q.sendKeyOn(sequence, ch, evt.Note)
 
 	case *event.PitchBendEvent:
 		cs.PitchBend = evt.Value
-		delta := float64(cs.PitchBend) * float64(cs.PitchBendRange) / 8192.0
-		for note := range cs.GateTimeRest {
-			chTo := sequence.ChannelTo(ch, note)
-			q.port.SendPitch(chTo, note, delta)
-		}
+		q.sendPitch(sequence, ch)
+
+	case *event.FineTuneEvent:
+		cs.FineTune = evt.Value
+		q.sendFineTune(sequence, ch)
 
 	case *event.ControlChangeEvent:
 		q.sendCC(sequence, evt)
@@ -342,6 +560,124 @@ func (q *Sequencer) processEvent(sequence *chunk.ScoreTrackSequenceDataChunk, ga
 	}
 }
 
+// soundingNote returns the note number actually sent to YMF825 for the note of the channel
+func (q *Sequencer) soundingNote(cs *ChannelState, note enums.Note) enums.Note {
+	if cs.KeyControlStatus == enums.KeyControlStatus_Off {
+		toneID := State.GetToneIDByPCAndDrumNote(cs.BankMSB, cs.BankLSB, cs.PC, note)
+		if 0 <= toneID {
+			note = State.Tones[toneID].Voice.(*voice.VM35FMVoice).DrumKey
+		}
+	}
+	note += enums.Note(cs.OctaveShift * 12)
+	if cs.IsTransposable() {
+		note = note.Transpose(q.transpose)
+	}
+	return note
+}
+
+// sendKeyOn sends KeyOn of the note with the current state of the channel
+func (q *Sequencer) sendKeyOn(sequence *chunk.ScoreTrackSequenceDataChunk, ch enums.Channel, note enums.Note) {
+	cs := State.Channels[ch]
+	vel := float64(cs.Velocity) / 127.0
+	exp := float64(cs.Expression) / 127.0
+	var vol float64
+	if State.IsMA5 {
+		vol = vel + exp - 1.0
+		if vol < .0 {
+			vol = .0
+		}
+	} else {
+		vol = (vel + exp) * .5
+		if vel == .0 || exp == .0 {
+			vol = .0
+		}
+	}
+	if debugFlags.Volume {
+		vol = 1.0
+	}
+	delta := cs.PitchDelta()
+	toneID := cs.ToneID
+	if cs.KeyControlStatus == enums.KeyControlStatus_Off {
+		toneID = State.GetToneIDByPCAndDrumNote(cs.BankMSB, cs.BankLSB, cs.PC, note)
+	}
+	if debugFlags.Tone {
+		toneID = 0
+	}
+	if toneID < 0 {
+		return
+	}
+	VoVol := int(math.Floor(.5 + 31.0*vol))
+	alloc := allocator(sequence)
+	if alloc == nil {
+		q.port.SendKeyOn(sequence.ChannelTo(ch, note), q.soundingNote(cs, note), delta, VoVol, toneID)
+		return
+	}
+	for _, v := range alloc.NoteOn(ch, note) {
+		// The voice may have been used by another channel
+		q.port.SendVolume(v, scale127(cs.Volume, 31, 1.0), true)
+		q.port.SendVibrato(v, scale127(cs.Modulation, 7, 1.0))
+		q.port.SendFineTuneByFloat(v, q.tuneRatio*cs.FineTuneRatio())
+		q.port.SendKeyOn(v, q.soundingNote(cs, note), delta, VoVol, toneID)
+	}
+}
+
+// noteVoices returns the voices which play the note of the channel
+func noteVoices(sequence *chunk.ScoreTrackSequenceDataChunk, ch enums.Channel, note enums.Note) []int {
+	if alloc := allocator(sequence); alloc != nil {
+		return alloc.NoteVoices(ch, note)
+	}
+	return []int{sequence.ChannelTo(ch, note)}
+}
+
+func (q *Sequencer) sendKeyOff(sequence *chunk.ScoreTrackSequenceDataChunk, ch enums.Channel, notes []enums.Note) {
+	cs := State.Channels[ch]
+	alloc := allocator(sequence)
+	for _, note := range notes {
+		toneID := cs.ToneID
+		if cs.KeyControlStatus == enums.KeyControlStatus_Off {
+			toneID = State.GetToneIDByPCAndDrumNote(cs.BankMSB, cs.BankLSB, cs.PC, note)
+		}
+		voices := noteVoices(sequence, ch, note)
+		if alloc != nil {
+			voices = alloc.NoteOff(ch, note)
+		}
+		for _, v := range voices {
+			q.port.SendKeyOff(v, toneID)
+		}
+	}
+}
+
+func (q *Sequencer) sendPitch(sequence *chunk.ScoreTrackSequenceDataChunk, ch enums.Channel) {
+	if q.chasing {
+		return
+	}
+	cs := State.Channels[ch]
+	delta := cs.PitchDelta()
+	for note := range cs.NoteOffTime {
+		for _, v := range noteVoices(sequence, ch, note) {
+			q.port.SendPitch(v, q.soundingNote(cs, note), delta)
+		}
+	}
+}
+
+func (q *Sequencer) sendFineTune(sequence *chunk.ScoreTrackSequenceDataChunk, ch enums.Channel) {
+	if q.chasing {
+		return
+	}
+	r := q.tuneRatio * State.Channels[ch].FineTuneRatio()
+	for _, chTo := range sequence.ChannelsTo(ch) {
+		q.port.SendFineTuneByFloat(chTo, r)
+	}
+}
+
+// setPan passes the panpot to the allocator, which chooses the devices playing the following notes in the pan mode.
+// YMF825 itself has a mono output
+func (q *Sequencer) setPan(sequence *chunk.ScoreTrackSequenceDataChunk, ch enums.Channel, panpot int) {
+	if alloc := allocator(sequence); alloc != nil {
+		alloc.SetPan(ch, panpot)
+	}
+}
+
 func (q *Sequencer) sendCC(sequence *chunk.ScoreTrackSequenceDataChunk, evt *event.ControlChangeEvent) {
 	ch := evt.GetChannel()
 	cs := State.Channels[ch]
@@ -351,6 +687,9 @@ func (q *Sequencer) sendCC(sequence *chunk.ScoreTrackSequenceDataChunk, evt *eve
 		cs.BankMSB = evt.Value
 	case enums.CC_Modulation:
 		cs.Modulation = evt.Value
+		if q.chasing {
+			break
+		}
 		for _, chTo := range chsTo {
 			q.port.SendVibrato(chTo, scale127(evt.Value, 7, 1.0))
 		}
@@ -360,11 +699,15 @@ func (q *Sequencer) sendCC(sequence *chunk.ScoreTrackSequenceDataChunk, evt *eve
 			vol = 127
 		}
 		cs.Volume = vol
+		if q.chasing {
+			break
+		}
 		for _, chTo := range chsTo {
 			q.port.SendVolume(chTo, scale127(vol, 31, 1.0), true)
 		}
 	case enums.CC_Panpot:
 		cs.Panpot = evt.Value
+		q.setPan(sequence, ch, evt.Value)
 	case enums.CC_Expression:
 		cs.Expression = evt.Value
 	case enums.CC_BankSelectLSB:
@@ -378,28 +721,20 @@ func (q *Sequencer) sendCC(sequence *chunk.ScoreTrackSequenceDataChunk, evt *eve
 	case enums.CC_RPNMSB:
 		cs.RPNMSB = evt.Value
 	case enums.CC_AllSoundOff:
-		notes := cs.AllOff()
-		for _, note := range notes {
-			chTo := sequence.ChannelTo(enums.Channel(ch), note)
-			toneID := cs.ToneID
-			if cs.KeyControlStatus == enums.KeyControlStatus_Off {
-				toneID = State.GetToneIDByPCAndDrumNote(cs.BankMSB, cs.BankLSB, cs.PC, note)
-			}
-			q.port.SendKeyOff(chTo, toneID)
-		}
+		q.sendKeyOff(sequence, ch, cs.AllOff())
 	case enums.CC_DataEntry:
 		switch cs.RPNMSB {
 		case 0:
 			switch cs.RPNLSB {
 			case 0: // Pitch bend sensitivity
 				cs.PitchBendRange = evt.Value
-				delta := float64(cs.PitchBend) * float64(cs.PitchBendRange) / 8192.0
-				for note := range cs.GateTimeRest {
-					chTo := sequence.ChannelTo(ch, note)
-					q.port.SendPitch(chTo, note, delta)
-				}
-			//case 1: // Master fine tuning
-			//case 2: // Master coarse tuning
+				q.sendPitch(sequence, ch)
+			case 1: // Master fine tuning
+				cs.FineTuning = evt.Value
+				q.sendFineTune(sequence, ch)
+			case 2: // Master coarse tuning
+				cs.CoarseTuning = evt.Value
+				q.sendPitch(sequence, ch)
 			default:
 				log.Warnf("Unsupported RPN %d-%d = %d", cs.RPNMSB, cs.RPNLSB, evt.Value)
 			}
@@ -416,8 +751,15 @@ func Test(deviceName string) error {
 	if err != nil {
 		return errors.WithStack(err)
 	}
+	sp.Start(context.Background())
 	defer sp.Close()
+	TestScale(sp, 440)
+	sp.SendTerminate()
+	return nil
+}
 
+// TestScale plays a scale for 3 octaves with a built-in tone. tune is the frequency of A4 in Hz
+func TestScale(sp *serial.SerialPort, tune float64) {
 	// 初期化処理について
 	// http://madscient.hatenablog.jp/entry/2017/08/13/013913
 	// https://github.com/yamaha-webmusic/ymf825board/blob/master/manual/fbd_spec1.md#initialization-procedure
@@ -445,7 +787,7 @@ func Test(deviceName string) error {
 	sp.SendMuteAndEGReset(ch)
 	sp.SendVolume(ch, 28, true)
 	sp.SendVibrato(ch, 0)
-	sp.SendFineTune(ch, 1, 0)
+	sp.SendFineTuneByFloat(ch, tune/440.0)
 
 	for o := 1; o < 4; o++ {
 		for _, i := range []int{0, 2, 4, 5, 7, 9, 11} {
@@ -456,8 +798,4 @@ func Test(deviceName string) error {
 			time.Sleep(100 * time.Millisecond)
 		}
 	}
-
-	sp.SendTerminate()
-
-	return nil
 }
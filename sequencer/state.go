@@ -2,6 +2,7 @@ package sequencer
 
 import (
 	"fmt"
+	"math"
 
 	"sort"
 
@@ -13,14 +14,18 @@ import (
 
 type ChannelState struct {
 	KeyControlStatus enums.KeyControlStatus
+	ChannelType      enums.ChannelType
 	Velocity         int
-	GateTimeRest     map[enums.Note]int
+	NoteOffTime      map[enums.Note]int
 	BankMSB          int
 	BankLSB          int
 	PC               int
 	ToneID           int
 	PitchBend        int
 	PitchBendRange   int
+	FineTune         int
+	FineTuning       int
+	CoarseTuning     int
 	Modulation       int
 	Volume           int
 	Panpot           int
@@ -31,41 +36,102 @@ type ChannelState struct {
 	RPNLSB           int
 }
 
-func (cs *ChannelState) Tick() []enums.Note {
+// Reset initializes the controller state except KeyControlStatus and ChannelType
+func (cs *ChannelState) Reset() {
+	*cs = ChannelState{
+		KeyControlStatus: cs.KeyControlStatus,
+		ChannelType:      cs.ChannelType,
+		NoteOffTime:      map[enums.Note]int{},
+		ToneID:           0,
+		Panpot:           64,
+		Volume:           100,
+		Expression:       127,
+		PitchBendRange:   2,
+		FineTuning:       64,
+		CoarseTuning:     64,
+	}
+}
+
+// Expire removes the notes whose note-off time is reached and returns them.
+// Notes with a negative note-off time are removed without being returned
+func (cs *ChannelState) Expire(now int) []enums.Note {
 	notes := []enums.Note{}
-	for note, t := range cs.GateTimeRest {
-		if t <= 0 {
-			delete(cs.GateTimeRest, note)
+	for note, t := range cs.NoteOffTime {
+		if t < 0 {
+			delete(cs.NoteOffTime, note)
 			continue
 		}
-		t--
-		cs.GateTimeRest[note] = t
-		if t == 0 {
+		if t <= now {
 			notes = append(notes, note)
-			delete(cs.GateTimeRest, note)
+			delete(cs.NoteOffTime, note)
 		}
 	}
 	return notes
 }
 
+// NextNoteOff returns the earliest note-off time of the notes being played
+func (cs *ChannelState) NextNoteOff() (int, bool) {
+	result, ok := 0, false
+	for _, t := range cs.NoteOffTime {
+		if 0 <= t && (!ok || t < result) {
+			result, ok = t, true
+		}
+	}
+	return result, ok
+}
+
 func (cs *ChannelState) AllOff() []enums.Note {
 	notes := []enums.Note{}
-	for note := range cs.GateTimeRest {
+	for note := range cs.NoteOffTime {
 		notes = append(notes, note)
 	}
-	cs.GateTimeRest = map[enums.Note]int{}
+	cs.NoteOffTime = map[enums.Note]int{}
 	return notes
 }
 
 func (cs *ChannelState) HasRest() bool {
-	return 0 < len(cs.GateTimeRest)
+	return 0 < len(cs.NoteOffTime)
+}
+
+// NoteOn registers the note to be turned off at the time noteOff (msec).
+// Unless poly is true or the channel is for drums, the other notes are removed and returned
+func (cs *ChannelState) NoteOn(note enums.Note, noteOff int, poly bool) []enums.Note {
+	dropped := []enums.Note{}
+	if !poly && cs.KeyControlStatus != enums.KeyControlStatus_Off {
+		for n := range cs.NoteOffTime {
+			if n != note {
+				dropped = append(dropped, n)
+			}
+		}
+		cs.NoteOffTime = map[enums.Note]int{}
+	}
+	cs.NoteOffTime[note] = noteOff
+	return dropped
+}
+
+// IsTransposable returns false for drum channels
+func (cs *ChannelState) IsTransposable() bool {
+	return cs.KeyControlStatus != enums.KeyControlStatus_Off && cs.ChannelType != enums.ChannelType_Rhythm
+}
+
+// PitchDelta returns the pitch offset in semitones given to enums.Note.Freq
+func (cs *ChannelState) PitchDelta() float64 {
+	return float64(cs.PitchBend)*float64(cs.PitchBendRange)/8192.0 + float64(cs.CoarseTuning-64)
 }
 
-func (cs *ChannelState) NoteOn(note enums.Note, gateTime int) {
-	if cs.KeyControlStatus != enums.KeyControlStatus_Off {
-		cs.GateTimeRest = map[enums.Note]int{}
+// FineTuneRatio returns the frequency multiplier to be written to INT/FRAC registers
+func (cs *ChannelState) FineTuneRatio() float64 {
+	// FineTuneEvent is only made from "00 [ch<<6|00] <fine>" of the SEQU sequence data (event.CreateEventSEQU),
+	// which is not described in the public SMAF Format Specification (HandyPhone Standard and Mobile Standard).
+	// The value is read as sign-magnitude (0x80+n means -n) as well as the octave shift "00 [ch<<6|32] <value>"
+	// of the same format, and 1/128 semitone per step is assumed
+	fine := cs.FineTune
+	if 0x80 <= fine {
+		fine = 0x80 - fine
 	}
-	cs.GateTimeRest[note] = gateTime
+	// RPN 0-1: 64 is center, +-1 semitone
+	semitones := float64(fine)/128.0 + float64(cs.FineTuning-64)/64.0
+	return math.Pow(2.0, semitones/12.0)
 }
 
 func (cs *ChannelState) Print(num int) {
@@ -80,8 +146,8 @@ func (cs *ChannelState) Print(num int) {
 		pan = fmt.Sprintf("R%d", cs.Panpot-64)
 	}
 	note := "-"
-	if 0 < len(cs.GateTimeRest) {
-		for n := range cs.GateTimeRest {
+	if 0 < len(cs.NoteOffTime) {
+		for n := range cs.NoteOffTime {
 			note = n.String()
 			break
 		}
@@ -165,15 +231,27 @@ func (ss *SequencerState) GetToneIDByPCAndDrumNote(bankMSB, bankLSB, PC int, not
 	return -1
 }
 
-func (ss *SequencerState) Tick(fn func(int, []enums.Note)) {
+// Expire calls fn with the notes whose note-off time is reached for each channel
+func (ss *SequencerState) Expire(now int, fn func(int, []enums.Note)) {
 	for ch := 0; ch < 16; ch++ {
-		notes := ss.Channels[ch].Tick()
+		notes := ss.Channels[ch].Expire(now)
 		if 0 < len(notes) {
 			fn(ch, notes)
 		}
 	}
 }
 
+// NextNoteOff returns the earliest note-off time over all channels
+func (ss *SequencerState) NextNoteOff() (int, bool) {
+	result, ok := 0, false
+	for ch := 0; ch < 16; ch++ {
+		if t, ok2 := ss.Channels[ch].NextNoteOff(); ok2 && (!ok || t < result) {
+			result, ok = t, true
+		}
+	}
+	return result, ok
+}
+
 func (ss *SequencerState) HasRest() bool {
 	for ch := 0; ch < 16; ch++ {
 		if ss.Channels[ch].HasRest() {
@@ -183,6 +261,22 @@ func (ss *SequencerState) HasRest() bool {
 	return false
 }
 
+// Reset clears tones and the state of all channels
+func (ss *SequencerState) Reset() {
+	ss.Tones = Tones{}
+	ss.IsMA5 = false
+	for i := range ss.Channels {
+		ss.Channels[i] = &ChannelState{KeyControlStatus: enums.KeyControlStatus_On}
+		ss.Channels[i].Reset()
+	}
+}
+
+func (ss *SequencerState) ResetChannels() {
+	for _, cs := range ss.Channels {
+		cs.Reset()
+	}
+}
+
 func (ss *SequencerState) Print() {
 	fmt.Print(cursor.ClearEntireScreen())
 	fmt.Print(cursor.MoveTo(0, 0))
@@ -195,16 +289,5 @@ func (ss *SequencerState) Print() {
 var State = SequencerState{Channels: [16]*ChannelState{}}
 
 func init() {
-	State.Tones = []*voice.VM35VoicePC{}
-	for i := 0; i < 16; i++ {
-		State.Channels[i] = &ChannelState{
-			KeyControlStatus: enums.KeyControlStatus_On,
-			GateTimeRest:     map[enums.Note]int{},
-			ToneID:           0,
-			Panpot:           64,
-			Volume:           100,
-			Expression:       127,
-			PitchBendRange:   2,
-		}
-	}
+	State.Reset()
 }
@@ -0,0 +1,30 @@
+package sequencer
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFineTuneRatio(t *testing.T) {
+	semitone := math.Pow(2.0, 1.0/12.0)
+	tests := []struct {
+		fineTune, fineTuning int
+		want                 float64
+	}{
+		{0, 64, 1.0},
+		{64, 64, math.Sqrt(semitone)},
+		{0x80 + 64, 64, 1.0 / math.Sqrt(semitone)},
+		{0x80, 64, 1.0},
+		{0, 0x40, 1.0},
+		{0, 0x7F, math.Pow(semitone, 63.0/64.0)},
+		{0, 0x00, 1.0 / semitone},
+		{64, 0x7F, math.Pow(semitone, .5+63.0/64.0)},
+	}
+	for _, tt := range tests {
+		cs := &ChannelState{FineTune: tt.fineTune, FineTuning: tt.fineTuning}
+		got := cs.FineTuneRatio()
+		if 1e-9 < math.Abs(got-tt.want) {
+			t.Errorf("FineTune=0x%02X FineTuning=0x%02X: got %f, want %f", tt.fineTune, tt.fineTuning, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package serial
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CaptureScheme is the prefix of device names which captures the bytes into a file instead of sending them
+const CaptureScheme = "file:"
+
+// captureFile returns the filename if the device name has the capture scheme
+func captureFile(deviceName string) string {
+	if !strings.HasPrefix(deviceName, CaptureScheme) {
+		return ""
+	}
+	return strings.TrimPrefix(deviceName[len(CaptureScheme):], "//")
+}
+
+// capture writes the bytes sent to the device into a file, and the device time (msec), offset and length
+// of the bytes executed at each time into the sidecar file "<file>.times".
+// The device time is the sum of the waits, and successive waits are merged into the fewest wait commands,
+// so that the same song is always captured into the same bytes regardless of the timing of the host
+type capture struct {
+	file    *os.File
+	times   *os.File
+	pending []byte // bytes of a command not completed yet
+	wait    int    // msec of the waits not written yet
+	now     int    // device time of the segment being written
+	segment int    // offset of the segment being written
+	written int
+}
+
+func newCapture(file string) (*capture, error) {
+	fh, err := os.Create(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	th, err := os.Create(file + ".times")
+	if err != nil {
+		fh.Close()
+		return nil, errors.WithStack(err)
+	}
+	return &capture{
+		file:  fh,
+		times: th,
+	}, nil
+}
+
+func (c *capture) Read(p []byte) (int, error) {
+	return 0, errors.Errorf("Capture device is not readable")
+}
+
+// commandLength returns the length of the command at the beginning of b, or 0 if b is too short to know it
+func commandLength(b []byte) int {
+	switch {
+	case len(b) == 0:
+		return 0
+	case b[0] == 0xFF:
+		return 3
+	case b[0]&0x80 != 0:
+		if len(b) < 3 {
+			return 0
+		}
+		return 3 + (int(b[1])<<8 | int(b[2]))
+	}
+	return 2
+}
+
+// waitMsec returns the msec of the wait command b, or -1 if b is not a wait command
+func waitMsec(b []byte) int {
+	if b[0] != 0xFF {
+		return -1
+	}
+	msec := int(b[1])<<8 | int(b[2])
+	if msec == 0xFFFF || msec&0xFF80 == 0x8000 {
+		return -1
+	}
+	return msec
+}
+
+func (c *capture) Write(p []byte) (int, error) {
+	c.pending = append(c.pending, p...)
+	for {
+		n := commandLength(c.pending)
+		if n == 0 || len(c.pending) < n {
+			break
+		}
+		b := c.pending[:n]
+		if msec := waitMsec(b); 0 <= msec {
+			c.wait += msec
+		} else if err := c.writeCommand(b); err != nil {
+			return 0, err
+		}
+		c.pending = c.pending[n:]
+	}
+	return len(p), nil
+}
+
+// writeCommand writes the waits held so far and then the command
+func (c *capture) writeCommand(b []byte) error {
+	if 0 < c.wait {
+		for w := c.wait; 0 < w; w -= MaxWaitMsec {
+			m := w
+			if MaxWaitMsec < m {
+				m = MaxWaitMsec
+			}
+			if err := c.writeBytes((&WaitCommand{Msec: m}).Bytes()); err != nil {
+				return err
+			}
+		}
+		if err := c.endSegment(); err != nil {
+			return err
+		}
+		c.now += c.wait
+		c.wait = 0
+	}
+	return c.writeBytes(b)
+}
+
+func (c *capture) writeBytes(b []byte) error {
+	n, err := c.file.Write(b)
+	c.written += n
+	return errors.WithStack(err)
+}
+
+// endSegment writes the time of the bytes written since the last wait
+func (c *capture) endSegment() error {
+	if c.written <= c.segment {
+		return nil
+	}
+	_, err := fmt.Fprintf(c.times, "%d\t%d\t%d\n", c.now, c.segment, c.written-c.segment)
+	c.segment = c.written
+	return errors.WithStack(err)
+}
+
+func (c *capture) Close() error {
+	// The last waits are kept, since the device waits for them before the next song
+	err := c.writeCommand(c.pending)
+	if err == nil {
+		err = c.endSegment()
+	}
+	if err2 := c.times.Close(); err == nil {
+		err = err2
+	}
+	if err2 := c.file.Close(); err == nil {
+		err = err2
+	}
+	return errors.WithStack(err)
+}
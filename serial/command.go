@@ -34,6 +34,9 @@ func (c *SPICommand) Bytes() []byte {
 	return append(hdr, c.Data...)
 }
 
+// MaxWaitMsec is the longest wait in a WaitCommand, which fits in a signed 16-bit int on the Arduino
+const MaxWaitMsec = 0x7FFF
+
 type WaitCommand struct {
 	Msec int
 }
@@ -42,6 +45,15 @@ func (c *WaitCommand) Bytes() []byte {
 	return []byte{0xFF, byte(c.Msec >> 8 & 255), byte(c.Msec & 255)}
 }
 
+// ReadCommand makes the sketch reply the value of the register as "reg <addr> <value>"
+type ReadCommand struct {
+	Addr uint8
+}
+
+func (c *ReadCommand) Bytes() []byte {
+	return []byte{0xFF, 0x80, c.Addr & 0x7F}
+}
+
 type TerminateCommand struct {
 }
 
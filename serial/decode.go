@@ -0,0 +1,172 @@
+package serial
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/but80/smaf825/smaf/enums"
+	"github.com/but80/smaf825/smaf/util"
+	"github.com/but80/smaf825/smaf/voice"
+	"github.com/but80/smaf825/ymf825"
+)
+
+// Decoder converts commands into a human readable timeline
+type Decoder struct {
+	Msec       int // cumulative time of the waits
+	selectedCh int
+	regs       [16][32]byte // control registers of each voice
+	lines      []string
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{
+		selectedCh: 0,
+		lines:      []string{},
+	}
+}
+
+// DecodeCommands returns a human readable timeline of the commands
+func DecodeCommands(commands []Command) string {
+	d := NewDecoder()
+	for i, c := range commands {
+		var next Command
+		if i+1 < len(commands) {
+			next = commands[i+1]
+		}
+		d.Decode(c, next)
+	}
+	return d.String()
+}
+
+func (d *Decoder) String() string {
+	return strings.Join(d.lines, "\n")
+}
+
+func (d *Decoder) printf(format string, args ...interface{}) {
+	d.lines = append(d.lines, fmt.Sprintf("%8d ms  ", d.Msec)+fmt.Sprintf(format, args...))
+}
+
+func (d *Decoder) printCh(format string, args ...interface{}) {
+	d.printf("Ch.%02d  "+format, append([]interface{}{d.selectedCh}, args...)...)
+}
+
+// Decode adds the lines for the command. next is the following command or nil, which is used to merge the register writes
+func (d *Decoder) Decode(c Command, next Command) {
+	switch cmd := c.(type) {
+	case *WaitCommand:
+		d.printf("wait %d ms", cmd.Msec)
+		d.Msec += cmd.Msec
+	case *ReadCommand:
+		d.printf("read #%d", cmd.Addr)
+	case *TerminateCommand:
+		d.printf("terminate")
+	case *SPICommand:
+		if len(cmd.Data) == 1 {
+			d.decodeWrite(cmd.Addr, cmd.Data[0], next)
+		} else {
+			d.decodeBurst(cmd.Addr, cmd.Data)
+		}
+	default:
+		d.printf("unknown %s", util.Hex(c.Bytes()))
+	}
+}
+
+func (d *Decoder) decodeWrite(addr, v byte, next Command) {
+	// Register writes to the same voice which are applied together are merged into one line
+	nextAddr, nextValue := -1, byte(0)
+	if n, ok := next.(*SPICommand); ok && len(n.Data) == 1 {
+		nextAddr, nextValue = int(n.Addr), n.Data[0]
+	}
+	r := ymf825.Lookup(addr)
+	if r == nil {
+		d.printf("#%d = 0x%02X", addr, v)
+		return
+	}
+	if r.PerVoice {
+		d.decodeVoiceWrite(r, v, nextAddr, nextValue)
+		return
+	}
+	switch r {
+	case ymf825.AnalogGain:
+		d.printf("analog gain %d", r.Unpack(v)[0])
+	case ymf825.SequencerSetting:
+		d.printf("sequencer setting 0x%02X", v)
+	case ymf825.SequencerVolume:
+		d.printf("seqvol %d", r.Unpack(v)[0])
+	case ymf825.VoiceSelect:
+		d.selectedCh = r.Unpack(v)[0]
+		d.printf("select Ch.%02d", d.selectedCh)
+	case ymf825.MasterVolume:
+		d.printf("master volume %d", r.Unpack(v)[0])
+	default:
+		d.printf("#%d %s %s", addr, r.Name, r.Format(v))
+	}
+}
+
+func (d *Decoder) decodeVoiceWrite(r *ymf825.Register, v byte, nextAddr int, nextValue byte) {
+	regs := &d.regs[d.selectedCh]
+	regs[r.Addr] = v
+	switch r {
+	case ymf825.VoiceVolume, ymf825.FnumHigh, ymf825.FineTuneHigh:
+		// printed with the following registers
+		if nextAddr == int(r.Addr)+1 {
+			return
+		}
+		d.printCh("#%d %s %s", r.Addr, r.Name, r.Format(v))
+	case ymf825.FnumLow:
+		if nextAddr == int(ymf825.KeyControl.Addr) && ymf825.KeyControl.Unpack(nextValue)[0] != 0 {
+			return
+		}
+		d.printCh("pitch %s", d.noteString(regs))
+	case ymf825.KeyControl:
+		k := r.Unpack(v)
+		keyOn, mute, egReset, tone := k[0], k[1], k[2], k[3]
+		switch {
+		case keyOn != 0:
+			d.printCh("key on  %s tone %d vovol %d", d.noteString(regs), tone, ymf825.VoiceVolume.Unpack(regs[ymf825.VoiceVolume.Addr])[0])
+		case mute != 0 || egReset != 0:
+			d.printCh("mute and EG reset")
+		default:
+			d.printCh("key off tone %d", tone)
+		}
+	case ymf825.ChannelVolume:
+		d.printCh("volume %d", r.Unpack(v)[0])
+	case ymf825.Vibrato:
+		d.printCh("vibrato %d", r.Unpack(v)[0])
+	case ymf825.FineTuneLow:
+		INT, FRAC := ymf825.UnpackFineTune(regs[ymf825.FineTuneHigh.Addr], v)
+		d.printCh("fine tune x%.4f", float64(INT)+float64(FRAC)/512.0)
+	}
+}
+
+func (d *Decoder) noteString(regs *[32]byte) string {
+	fnum, block := ymf825.UnpackFnum(regs[ymf825.FnumHigh.Addr], regs[ymf825.FnumLow.Addr])
+	note, delta := enums.NoteFromFreq(enums.NoteFreq{Block: block, Fnum: fnum})
+	return fmt.Sprintf("%-8s %+.2f", note.String(), delta)
+}
+
+func (d *Decoder) decodeBurst(addr byte, data []byte) {
+	if addr != ymf825.ContentsData.Addr || len(data) < 1 || data[0]&0x80 == 0 {
+		d.printf("#%d <= %s", addr, util.Hex(data))
+		return
+	}
+	n := int(data[0] & 0x7F)
+	d.printf("tones %d", n)
+	b := data[1:]
+	for i := 0; i < n; i++ {
+		if len(b) < voice.YMF825ToneSize {
+			d.lines = append(d.lines, fmt.Sprintf("\t[%d] truncated: %s", i, util.Hex(b)))
+			return
+		}
+		v, err := voice.NewVM35FMVoiceFromYMF825(b[:voice.YMF825ToneSize])
+		if err != nil {
+			d.lines = append(d.lines, fmt.Sprintf("\t[%d] %s", i, err.Error()))
+		} else {
+			d.lines = append(d.lines, util.Indent(fmt.Sprintf("[%d] ", i)+v.String(), "\t"))
+		}
+		b = b[voice.YMF825ToneSize:]
+	}
+	if len(b) != 4 || b[0] != 0x80 || b[1] != 0x03 || b[2] != 0x81 || b[3] != 0x80 {
+		d.lines = append(d.lines, fmt.Sprintf("\tunexpected trailer: %s", util.Hex(b)))
+	}
+}
@@ -0,0 +1,104 @@
+package serial
+
+import (
+	"time"
+
+	"github.com/but80/smaf825/smaf/log"
+)
+
+// Protocol v2 frames the byte stream of protocol v1 so that corrupted or dropped bytes are detected and resent.
+//
+//	| 0xA5 (SOF) | seq | len (1..FRAME_PAYLOAD_MAX) | payload (len bytes) | CRC-16 of seq, len and payload (2 bytes, big endian) |
+//
+// The sketch replies "+seq" for each frame it accepted, or "!seq" with the expected sequence number
+// when a frame is broken or missing. Then all frames from the expected one are sent again.
+// Credits ("=N") are the payload bytes consumed from the ring buffer of the sketch, as in protocol v1.
+const (
+	FRAME_SOF          = 0xA5
+	FRAME_PAYLOAD_MAX  = 64
+	maxUnackedFrames   = 64
+	retransmitInterval = 500 * time.Millisecond
+)
+
+// protocol2Switch is the v1 command which switches the sketch into protocol v2
+var protocol2Switch = []byte{0xFF, 0xFF, 0xFE}
+
+type frame struct {
+	seq    byte
+	bytes  []byte
+	sentAt time.Time
+}
+
+func newFrame(seq byte, payload []byte) *frame {
+	b := make([]byte, 0, len(payload)+5)
+	b = append(b, FRAME_SOF, seq, byte(len(payload)))
+	b = append(b, payload...)
+	crc := crc16(b[1:])
+	b = append(b, byte(crc>>8), byte(crc))
+	return &frame{seq: seq, bytes: b}
+}
+
+// crc16 calculates CRC-16/CCITT-FALSE (polynomial 0x1021, initial value 0xFFFF)
+func crc16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// seqNotAfter returns true if the sequence number a is equal to or before b
+func seqNotAfter(a, b byte) bool {
+	return int8(a-b) <= 0
+}
+
+// ackFrames forgets the frames up to seq, which the sketch has received
+func (sp *SerialPort) ackFrames(seq byte) {
+	for 0 < len(sp.unacked) && seqNotAfter(sp.unacked[0].seq, seq) {
+		sp.unacked = sp.unacked[1:]
+	}
+}
+
+// flushFramed sends the serialized buffer in frames of protocol v2
+func (sp *SerialPort) flushFramed() error {
+	if 0 < len(sp.unacked) && (sp.resend || retransmitInterval < time.Since(sp.unacked[0].sentAt)) {
+		sp.resend = false
+		log.Debugf("resending %d frames from #%d", len(sp.unacked), sp.unacked[0].seq)
+		sp.retransmitted += len(sp.unacked)
+		for _, f := range sp.unacked {
+			_, err := sp.ser.Write(f.bytes)
+			if err != nil {
+				return err
+			}
+			f.sentAt = time.Now()
+		}
+	}
+	for 0 < len(sp.buffer) && 0 < sp.sendable && len(sp.unacked) < maxUnackedFrames {
+		l := len(sp.buffer)
+		if sp.sendable < l {
+			l = sp.sendable
+		}
+		if FRAME_PAYLOAD_MAX < l {
+			l = FRAME_PAYLOAD_MAX
+		}
+		f := newFrame(sp.seq, sp.buffer[:l])
+		_, err := sp.ser.Write(f.bytes)
+		if err != nil {
+			return err
+		}
+		f.sentAt = time.Now()
+		sp.unacked = append(sp.unacked, f)
+		sp.seq++
+		sp.buffer = sp.buffer[l:]
+		sp.sentTotal += l
+		sp.sendable -= l
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package serial
+
+import (
+	"context"
+	"sync"
+
+	"github.com/but80/smaf825/smaf/enums"
+	"github.com/but80/smaf825/smaf/voice"
+)
+
+// VoicesPerPort is the number of voices of a YMF825
+const VoicesPerPort = 16
+
+// PortGroup drives several ports as one device.
+//
+// Voices are numbered through the ports, i.e. the voice v is played by the voice v%16 of the port v/16.
+// The commands not for a voice are sent to all ports, and the waits keep them synchronized
+type PortGroup struct {
+	ports []*SerialPort
+	errs  chan error
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// NewPortGroup opens the devices with NewSerialPort as a group
+func NewPortGroup(deviceNames []string, baudRate int) (*PortGroup, error) {
+	ports := []*SerialPort{}
+	for _, name := range deviceNames {
+		port, err := NewSerialPort(name, baudRate)
+		if err != nil {
+			for _, p := range ports {
+				p.Close()
+			}
+			return nil, err
+		}
+		ports = append(ports, port)
+	}
+	return NewPortGroupWithPorts(ports), nil
+}
+
+// NewPortGroupWithPorts makes the opened ports a group, which closes them by Close
+func NewPortGroupWithPorts(ports []*SerialPort) *PortGroup {
+	g := &PortGroup{
+		ports: ports,
+		errs:  make(chan error, 1),
+		done:  make(chan struct{}),
+	}
+	for _, p := range ports {
+		g.watch(p)
+	}
+	return g
+}
+
+// watch forwards the first error of the port to Err
+func (g *PortGroup) watch(p *SerialPort) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		select {
+		case err := <-p.Err():
+			select {
+			case g.errs <- err:
+			default:
+			}
+		case <-g.done:
+		}
+	}()
+}
+
+// Reconnect reconnects the ports which lost the connection
+func (g *PortGroup) Reconnect() error {
+	var result error
+	for _, p := range g.ports {
+		if !p.isBroken() {
+			continue
+		}
+		if err := p.Reconnect(); err != nil {
+			result = err
+			continue
+		}
+		g.watch(p)
+	}
+	if result == nil {
+		select {
+		case <-g.errs:
+		default:
+		}
+	}
+	return result
+}
+
+// Ports returns the ports in the group
+func (g *PortGroup) Ports() []*SerialPort {
+	return g.ports
+}
+
+// Voices returns the number of voices which can be played at once
+func (g *PortGroup) Voices() int {
+	return VoicesPerPort * len(g.ports)
+}
+
+// each calls fn with the port and its voice which play the voice v of the group
+func (g *PortGroup) each(v int, fn func(p *SerialPort, ch int)) {
+	if v < 0 || len(g.ports)*VoicesPerPort <= v {
+		return
+	}
+	fn(g.ports[v/VoicesPerPort], v%VoicesPerPort)
+}
+
+func (g *PortGroup) Start(ctx context.Context) {
+	for _, p := range g.ports {
+		p.Start(ctx)
+	}
+}
+
+// Close closes all ports and returns the first error
+func (g *PortGroup) Close() error {
+	var result error
+	for _, p := range g.ports {
+		if err := p.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+	select {
+	case <-g.done:
+	default:
+		close(g.done)
+	}
+	g.wg.Wait()
+	return result
+}
+
+// Err returns the channel which receives the first error occurred in any of the ports
+func (g *PortGroup) Err() <-chan error {
+	return g.errs
+}
+
+// Flush returns true if all commands are sent to all ports
+func (g *PortGroup) Flush() bool {
+	result := true
+	for _, p := range g.ports {
+		if !p.Flush() {
+			result = false
+		}
+	}
+	return result
+}
+
+func (g *PortGroup) Pause() {
+	for _, p := range g.ports {
+		p.Pause()
+	}
+}
+
+func (g *PortGroup) Resume() {
+	for _, p := range g.ports {
+		p.Resume()
+	}
+}
+
+// Metrics returns the sum of the statistics of the ports. Lag is the largest one
+func (g *PortGroup) Metrics() Metrics {
+	result := Metrics{}
+	for _, p := range g.ports {
+		result = result.add(p.Metrics())
+	}
+	return result
+}
+
+func (g *PortGroup) SendWait(msec int) {
+	for _, p := range g.ports {
+		p.SendWait(msec)
+	}
+}
+
+func (g *PortGroup) SendAllOff() {
+	for _, p := range g.ports {
+		p.SendAllOff()
+	}
+}
+
+func (g *PortGroup) SendMasterVolume(v int) {
+	for _, p := range g.ports {
+		p.SendMasterVolume(v)
+	}
+}
+
+func (g *PortGroup) SendAnalogGain(gain int) {
+	for _, p := range g.ports {
+		p.SendAnalogGain(gain)
+	}
+}
+
+func (g *PortGroup) SendSeqVol(v int) {
+	for _, p := range g.ports {
+		p.SendSeqVol(v)
+	}
+}
+
+// SendTones sends the same tones to all ports
+func (g *PortGroup) SendTones(data []*voice.VM35FMVoice) {
+	for _, p := range g.ports {
+		p.SendTones(data)
+	}
+}
+
+func (g *PortGroup) SendVibrato(v, vib int) {
+	g.each(v, func(p *SerialPort, ch int) { p.SendVibrato(ch, vib) })
+}
+
+func (g *PortGroup) SendVolume(v, ChVol int, DIR_CV bool) {
+	g.each(v, func(p *SerialPort, ch int) { p.SendVolume(ch, ChVol, DIR_CV) })
+}
+
+func (g *PortGroup) SendFineTune(v, INT, FRAC int) {
+	g.each(v, func(p *SerialPort, ch int) { p.SendFineTune(ch, INT, FRAC) })
+}
+
+func (g *PortGroup) SendFineTuneByFloat(v int, r float64) {
+	g.each(v, func(p *SerialPort, ch int) { p.SendFineTuneByFloat(ch, r) })
+}
+
+func (g *PortGroup) SendKeyOn(v int, note enums.Note, delta float64, VoVol, ToneNum int) {
+	g.each(v, func(p *SerialPort, ch int) { p.SendKeyOn(ch, note, delta, VoVol, ToneNum) })
+}
+
+func (g *PortGroup) SendPitch(v int, note enums.Note, delta float64) {
+	g.each(v, func(p *SerialPort, ch int) { p.SendPitch(ch, note, delta) })
+}
+
+func (g *PortGroup) SendKeyOff(v, ToneNum int) {
+	g.each(v, func(p *SerialPort, ch int) { p.SendKeyOff(ch, ToneNum) })
+}
+
+func (g *PortGroup) SendMuteAndEGReset(v int) {
+	g.each(v, func(p *SerialPort, ch int) { p.SendMuteAndEGReset(ch) })
+}
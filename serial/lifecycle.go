@@ -0,0 +1,140 @@
+package serial
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/but80/smaf825/smaf/log"
+	"github.com/pkg/errors"
+)
+
+// flushInterval is the interval to send the queued commands. Credits from the sketch trigger sending immediately
+const flushInterval = 8 * time.Millisecond
+
+// Start starts sending the queued commands in background.
+// When ctx is done, the port is closed as by Close
+func (sp *SerialPort) Start(ctx context.Context) {
+	sp.bufferMutex.Lock()
+	defer sp.bufferMutex.Unlock()
+	if sp.closed || sp.cancel != nil {
+		return
+	}
+	ctx, sp.cancel = context.WithCancel(ctx)
+	sp.wg.Add(1)
+	go func() {
+		defer sp.wg.Done()
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				go sp.Close()
+				return
+			case <-ticker.C:
+			case <-sp.flushNow:
+			}
+			sp.Flush()
+		}
+	}()
+}
+
+// Close stops the goroutines of the port and closes the connection.
+// It returns after the goroutines exit
+func (sp *SerialPort) Close() error {
+	sp.closeOnce.Do(func() {
+		sp.bufferMutex.Lock()
+		cancel := sp.cancel
+		sp.bufferMutex.Unlock()
+		if cancel != nil {
+			cancel()
+		}
+		if sp.baudRate != 0 && !sp.closed && !sp.broken {
+			// Makes the sketch go back to DefaultBaudRate for the next connection
+			sp.sendControl(helloSequence)
+		}
+		sp.bufferMutex.Lock()
+		sp.closed = true
+		conn := sp.ser
+		sp.ser = nil
+		sp.bufferMutex.Unlock()
+		if conn != nil {
+			log.Infof("closing serial port")
+			sp.closeErr = errors.WithStack(conn.Close())
+			log.Infof("done")
+		}
+	})
+	sp.wg.Wait()
+	return sp.closeErr
+}
+
+// Reconnect opens the device again after the connection is lost, and resets the session of the sketch.
+// The commands not sent yet are discarded, so the caller should send the whole state again
+func (sp *SerialPort) Reconnect() error {
+	sp.bufferMutex.Lock()
+	simple := sp.isNullDevice() || sp.capturing
+	closed := sp.closed && !simple
+	sp.discard()
+	sp.bufferMutex.Unlock()
+	// The shadow has been updated while the commands were dropped, so it does not match the chip anymore
+	sp.invalidateRegisters()
+	if closed {
+		return fmt.Errorf("Serial port is closed")
+	}
+	if !simple {
+		sp.detach()
+		log.Infof("reopening %s", sp.deviceName)
+		conn, err := OpenTransport(sp.deviceName, DefaultBaudRate)
+		if err != nil {
+			return err
+		}
+		if err := sp.open(conn); err != nil {
+			sp.detach()
+			return err
+		}
+	}
+	sp.bufferMutex.Lock()
+	defer sp.bufferMutex.Unlock()
+	select {
+	case <-sp.errs:
+	default:
+	}
+	sp.broken = false
+	return nil
+}
+
+func (sp *SerialPort) isBroken() bool {
+	sp.bufferMutex.Lock()
+	defer sp.bufferMutex.Unlock()
+	return sp.broken
+}
+
+// discard clears the queues and the state of the transmission for a new session
+func (sp *SerialPort) discard() {
+	sp.commands = []Command{}
+	sp.priority = nil
+	sp.buffer = []byte{}
+	sp.enqueuedAt = nil
+	sp.queuedBytes = 0
+	sp.unacked = nil
+	sp.resend = false
+	sp.seq = 0
+	sp.protocol = 1
+	sp.baudRate = 0
+	sp.window = ARDUINO_BUFFER_SIZE
+	sp.sendable = ARDUINO_BUFFER_SIZE
+}
+
+// Err returns the channel which receives an error occurred in background.
+// After the error, the port stops sending and Flush returns true
+func (sp *SerialPort) Err() <-chan error {
+	return sp.errs
+}
+
+func (sp *SerialPort) report(err error) {
+	log.Debugf("serial port error: %s", err.Error())
+	select {
+	case sp.errs <- err:
+	default:
+	}
+}
@@ -0,0 +1,89 @@
+package serial
+
+import (
+	"fmt"
+	"time"
+)
+
+// Metrics is the statistics of the transmission to the sketch
+type Metrics struct {
+	Window        int           // bytes which the sketch can receive at once
+	Queued        int           // bytes waiting to be sent
+	InFlight      int           // bytes sent but not yet consumed by the sketch
+	MaxBacklog    int           // largest Queued so far
+	Starved       time.Duration // total time when the queue waited for credits
+	Lag           time.Duration // how long the oldest queued command has been waiting, i.e. how far the device is behind schedule
+	Sent          int           // bytes sent in total
+	Retransmitted int           // frames sent again in protocol v2
+	Suppressed    int           // bytes not sent because the registers already had the values
+}
+
+func (m Metrics) String() string {
+	return fmt.Sprintf(
+		"sent %d bytes, suppressed %d bytes, queued %d bytes (max %d), in flight %d/%d bytes, starved %v, lag %v, retransmitted %d frames",
+		m.Sent, m.Suppressed, m.Queued, m.MaxBacklog, m.InFlight, m.Window,
+		m.Starved.Round(time.Millisecond), m.Lag.Round(time.Millisecond), m.Retransmitted,
+	)
+}
+
+// Metrics returns the current statistics of the transmission
+func (sp *SerialPort) Metrics() Metrics {
+	sp.bufferMutex.Lock()
+	defer sp.bufferMutex.Unlock()
+	m := Metrics{
+		Window:        sp.window,
+		Queued:        sp.queuedBytes + len(sp.buffer),
+		InFlight:      sp.window - sp.sendable,
+		MaxBacklog:    sp.maxBacklog,
+		Starved:       sp.starved,
+		Sent:          sp.sentTotal,
+		Retransmitted: sp.retransmitted,
+		Suppressed:    sp.suppressed,
+	}
+	if m.InFlight < 0 || sp.capturing {
+		m.InFlight = 0
+	}
+	if !sp.starvedSince.IsZero() {
+		m.Starved += time.Since(sp.starvedSince)
+	}
+	if !sp.held && 0 < len(sp.enqueuedAt) {
+		m.Lag = time.Since(sp.enqueuedAt[0])
+	}
+	return m
+}
+
+// add returns the sum of the statistics of two ports
+func (m Metrics) add(o Metrics) Metrics {
+	m.Window += o.Window
+	m.Queued += o.Queued
+	m.InFlight += o.InFlight
+	m.MaxBacklog += o.MaxBacklog
+	m.Starved += o.Starved
+	if m.Lag < o.Lag {
+		m.Lag = o.Lag
+	}
+	m.Sent += o.Sent
+	m.Retransmitted += o.Retransmitted
+	m.Suppressed += o.Suppressed
+	return m
+}
+
+func (sp *SerialPort) addQueued(n int) {
+	sp.queuedBytes += n
+	if q := sp.queuedBytes + len(sp.buffer); sp.maxBacklog < q {
+		sp.maxBacklog = q
+	}
+}
+
+// updateStarvation accumulates the time when data is waiting but no credits are left
+func (sp *SerialPort) updateStarvation() {
+	pending := 0 < len(sp.buffer) || 0 < len(sp.priority) || (!sp.held && 0 < len(sp.commands))
+	if pending && sp.sendable <= 0 {
+		if sp.starvedSince.IsZero() {
+			sp.starvedSince = time.Now()
+		}
+	} else if !sp.starvedSince.IsZero() {
+		sp.starved += time.Since(sp.starvedSince)
+		sp.starvedSince = time.Time{}
+	}
+}
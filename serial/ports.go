@@ -0,0 +1,139 @@
+package serial
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/but80/smaf825/smaf/log"
+	"github.com/pkg/errors"
+)
+
+// AutoDevice is the device name which selects the only serial port running the bridge sketch
+const AutoDevice = "auto"
+
+// probeTimeout limits the time for a port which blocks on open
+const probeTimeout = 20 * time.Second
+
+// SketchVersionError is returned when the sketch is not compatible with this program
+type SketchVersionError struct {
+	Version int
+}
+
+func (e *SketchVersionError) Error() string {
+	return fmt.Sprintf(
+		`Sketch version mismatch (want %d <= version < %d, got %d). Please rewrite "bridge/bridge.ino" onto Arduino.`,
+		SKETCH_VERSION_GTE, SKETCH_VERSION_LT, e.Version,
+	)
+}
+
+// CandidatePorts returns the names of the serial ports which may be connected to Arduino
+func CandidatePorts() []string {
+	if runtime.GOOS == "windows" {
+		result := []string{}
+		for i := 1; i <= 32; i++ {
+			result = append(result, fmt.Sprintf("COM%d", i))
+		}
+		return result
+	}
+	patterns := []string{"/dev/ttyUSB*", "/dev/ttyACM*"}
+	if runtime.GOOS == "darwin" {
+		patterns = []string{"/dev/tty.usbserial*", "/dev/tty.usbmodem*", "/dev/tty.wchusbserial*"}
+	}
+	result := []string{}
+	for _, p := range patterns {
+		names, _ := filepath.Glob(p)
+		result = append(result, names...)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// ProbeResult is the result of connecting to a serial port
+type ProbeResult struct {
+	Name      string
+	Available bool        // the port could be opened
+	Version   int         // version of the sketch, or 0 if it did not respond
+	Port      *SerialPort // opened port if the sketch is compatible
+	Err       error
+}
+
+// ProbePorts connects to the ports in parallel with the same handshake as NewSerialPort,
+// except that nothing is sent to the ports until the sketch announces itself.
+// The ports of compatible sketches are left open
+func ProbePorts(names []string, baudRate int) []*ProbeResult {
+	results := make([]*ProbeResult, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		results[i] = &ProbeResult{Name: name}
+		wg.Add(1)
+		go func(r *ProbeResult) {
+			defer wg.Done()
+			type opened struct {
+				available bool
+				port      *SerialPort
+				err       error
+			}
+			c := make(chan opened, 1)
+			go func() {
+				conn, err := OpenTransport(r.Name, DefaultBaudRate)
+				if err != nil {
+					c <- opened{false, nil, err}
+					return
+				}
+				port, err := newSerialPortWithConn(r.Name, conn, baudRate, true)
+				c <- opened{true, port, err}
+			}()
+			select {
+			case o := <-c:
+				r.Available, r.Port, r.Err = o.available, o.port, o.err
+			case <-time.After(probeTimeout):
+				r.Err = fmt.Errorf("Timed out")
+				go func() {
+					if o := <-c; o.port != nil {
+						o.port.Close()
+					}
+				}()
+				return
+			}
+			if r.Port != nil {
+				r.Version = r.Port.sketchVersion
+			} else if e, ok := errors.Cause(r.Err).(*SketchVersionError); ok {
+				r.Version = e.Version
+			}
+		}(results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+// openAuto opens the only port which responds as a compatible bridge
+func openAuto(baudRate int) (*SerialPort, error) {
+	names := CandidatePorts()
+	if len(names) == 0 {
+		return nil, fmt.Errorf("No serial ports found")
+	}
+	found := []*ProbeResult{}
+	for _, r := range ProbePorts(names, baudRate) {
+		if r.Port != nil {
+			found = append(found, r)
+		}
+	}
+	if len(found) == 1 {
+		log.Infof("found bridge on %s", found[0].Name)
+		return found[0].Port, nil
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("No bridge found in %s", strings.Join(names, ", "))
+	}
+	foundNames := []string{}
+	for _, r := range found {
+		r.Port.Close()
+		foundNames = append(foundNames, r.Name)
+	}
+	return nil, fmt.Errorf("Multiple bridges found in %s. Please specify one of them", strings.Join(foundNames, ", "))
+}
@@ -1,6 +1,7 @@
 package serial
 
 import (
+	"context"
 	"math"
 
 	"bufio"
@@ -17,18 +18,47 @@ import (
 	"github.com/but80/smaf825/smaf/enums"
 	"github.com/but80/smaf825/smaf/log"
 	"github.com/but80/smaf825/smaf/voice"
-	"github.com/jacobsa/go-serial/serial"
+	"github.com/but80/smaf825/ymf825"
 	"github.com/pkg/errors"
-	"github.com/xlab/closer"
 )
 
 const (
-	SKETCH_VERSION_GTE  = 120
-	SKETCH_VERSION_LT   = 140
-	ARDUINO_BUFFER_SIZE = 60
+	SKETCH_VERSION_GTE       = 120
+	SKETCH_VERSION_LT        = 160
+	SKETCH_VERSION_PROTOCOL2 = 140 // sketches of this version or later support protocol v2
+	SKETCH_VERSION_HELLO     = 140 // sketches of this version or later accept hello
+	SKETCH_VERSION_READ      = 140 // sketches of this version or later accept ReadCommand
+	SKETCH_VERSION_BAUD      = 140 // sketches of this version or later can change the baud rate
+	SKETCH_VERSION_QUERY     = 150 // sketches of this version or later reply to versionQuery
+	ARDUINO_BUFFER_SIZE      = 60  // credit window for the sketches which do not advertise their buffer size
 )
 
-var BaudRates = []int{300, 600, 1200, 2400, 4800, 9600, 14400, 19200, 28800, 38400, 57600, 115200}
+const (
+	bannerTimeout   = 2500 * time.Millisecond // time for the sketch to boot after the port is opened
+	helloTimeout    = time.Second
+	maxHelloRetries = 3
+	readTimeout     = 2 * time.Second
+	requestTimeout  = time.Second
+)
+
+// DefaultBaudRate is the baud rate at which the sketch starts (BAUD_RATE in bridge.ino)
+const DefaultBaudRate = 57600
+
+// helloSequence makes the sketch discard all received data, reinitialize YMF825 and announce "ready" again.
+// It is detected by the sketch regardless of the parser state
+// Older sketches read it as a long wait followed by register writes, so it is sent only to the sketches known to accept it
+var helloSequence = []byte{0xFF, 0xFF, 0xFD, 'h', 'e', 'l', 'l', 'o'}
+
+// versionQuery makes the sketch announce "ready" again without resetting the session.
+// Older sketches execute it as waits of 1, 2 and 3 ms
+var versionQuery = []byte{0xFF, 0x00, 0x01, 0xFF, 0x00, 0x02, 0xFF, 0x00, 0x03}
+
+var (
+	baudQuery = []byte{0xFF, 0xFF, 0xFC} // replied with "bauds <rate> ..."
+	baudPing  = []byte{0xFF, 0xFF, 0xFB} // replied with "pong"
+)
+
+var BaudRates = []int{300, 600, 1200, 2400, 4800, 9600, 14400, 19200, 28800, 38400, 57600, 115200, 230400, 250000, 500000, 1000000}
 
 func IsValidBaudRate(r int) bool {
 	for _, v := range BaudRates {
@@ -49,181 +79,683 @@ type SerialPort struct {
 	ser           io.ReadWriteCloser
 	closed        bool
 	selectedCh    int
+	shadow        shadowRegisters
+	suppressed    int // bytes of the writes skipped by the shadow
 	sketchVersion int
 	commands      []Command
+	priority      []Command
+	held          bool
+	recording     bool
+	capturing     bool
 	buffer        []byte
 	sentTotal     int
 	sendable      int
 	bufferMutex   sync.Mutex
+	protocol      int
+	lines         chan string // lines from the sketch except credits and acks
+	reads         chan registerValue
+	seq           byte
+	unacked       []*frame
+	resend        bool
+	retransmitted int
+	baudRate      int  // baud rate switched to by negotiation, or 0
+	wantBaudRate  int  // baud rate requested by the caller, or 0
+	passive       bool // sends nothing until the banner of the sketch arrives
+	window        int  // bytes which the sketch can receive at once
+	cancel        context.CancelFunc
+	wg            sync.WaitGroup // reader and flusher
+	closeOnce     sync.Once
+	closeErr      error
+	errs          chan error
+	broken        bool // stopped sending because of an error
+	flushNow      chan struct{}
+	queuedBytes   int         // bytes of commands and priority
+	enqueuedAt    []time.Time // time when each of commands is queued
+	maxBacklog    int
+	starvedSince  time.Time
+	starved       time.Duration
 }
 
-func NewSerialPort(deviceName string, baudRate int) (*SerialPort, error) {
-	log.Infof("opening serial port")
+func newSerialPort(deviceName string) *SerialPort {
 	sp := &SerialPort{
 		deviceName: deviceName,
 		selectedCh: -1,
 		commands:   []Command{},
 		buffer:     []byte{},
 		sendable:   ARDUINO_BUFFER_SIZE,
+		window:     ARDUINO_BUFFER_SIZE,
+		protocol:   1,
+		flushNow:   make(chan struct{}, 1),
+		errs:       make(chan error, 1),
+	}
+	sp.shadow.invalidate()
+	return sp
+}
+
+// NewSerialPort opens the device, which is a serial port name, a URI accepted by OpenTransport or AutoDevice
+func NewSerialPort(deviceName string, baudRate int) (*SerialPort, error) {
+	if deviceName == AutoDevice {
+		log.Infof("searching for the bridge")
+		return openAuto(baudRate)
 	}
+	log.Infof("opening serial port")
+	return openSerialPort(deviceName, baudRate)
+}
+
+func openSerialPort(deviceName string, baudRate int) (*SerialPort, error) {
+	sp := newSerialPort(deviceName)
 	if sp.isNullDevice() {
 		sp.closed = true
-	} else {
-		var err error
-		sp.ser, err = serial.Open(serial.OpenOptions{
-			PortName:              deviceName,
-			BaudRate:              uint(baudRate),
-			DataBits:              8,
-			StopBits:              1,
-			ParityMode:            serial.PARITY_EVEN,
-			InterCharacterTimeout: 10000,
-			MinimumReadSize:       0,
-		})
+		return sp, nil
+	}
+	if file := captureFile(deviceName); file != "" {
+		log.Infof("capturing into %s", file)
+		c, err := newCapture(file)
 		if err != nil {
-			return nil, errors.WithStack(err)
+			return nil, err
 		}
-		closer.Bind(func() {
-			sp.Close()
-		})
-		wait := make(chan error)
-		go func() {
-			reader := bufio.NewReaderSize(sp.ser, 2048)
-			for !sp.closed {
-				line, _, err := reader.ReadLine()
-				if err == io.EOF {
-					if wait != nil {
-						wait <- err
-					}
-					return
+		sp.ser = c
+		sp.capturing = true
+		return sp, nil
+	}
+	if !IsSerialDevice(deviceName) {
+		conn, err := OpenTransport(deviceName, baudRate)
+		if err != nil {
+			return nil, err
+		}
+		return NewSerialPortWithConn(deviceName, conn)
+	}
+	// The sketch always starts at DefaultBaudRate, and then switches to baudRate by negotiation
+	conn, err := OpenTransport(deviceName, DefaultBaudRate)
+	if err != nil {
+		return nil, err
+	}
+	return newSerialPortWithConn(deviceName, conn, baudRate, false)
+}
+
+// NewSerialPortWithConn communicates with the bridge sketch over the connection, which is closed by Close
+func NewSerialPortWithConn(deviceName string, conn io.ReadWriteCloser) (*SerialPort, error) {
+	return newSerialPortWithConn(deviceName, conn, 0, false)
+}
+
+// newSerialPortWithConn opens the port. If passive, nothing is sent to a device which does not announce itself as the bridge
+func newSerialPortWithConn(deviceName string, conn io.ReadWriteCloser, baudRate int, passive bool) (*SerialPort, error) {
+	sp := newSerialPort(deviceName)
+	sp.wantBaudRate = baudRate
+	sp.passive = passive
+	err := sp.open(conn)
+	if err != nil {
+		sp.Close()
+		return nil, errors.WithStack(err)
+	}
+	return sp, nil
+}
+
+// open connects to the sketch and negotiates the baud rate and the protocol
+func (sp *SerialPort) open(conn io.ReadWriteCloser) error {
+	err := sp.connect(conn)
+	if err == nil && sp.wantBaudRate != 0 && sp.wantBaudRate != DefaultBaudRate {
+		err = sp.negotiateBaudRate(sp.wantBaudRate)
+	}
+	if err != nil {
+		return err
+	}
+	if SKETCH_VERSION_PROTOCOL2 <= sp.sketchVersion {
+		sp.negotiateProtocol2()
+	}
+	log.Debugf("protocol v%d", sp.protocol)
+	return nil
+}
+
+// connect starts communication over the connection and resets the session of the sketch
+func (sp *SerialPort) connect(conn io.ReadWriteCloser) error {
+	sp.attach(conn)
+	return sp.handshake()
+}
+
+// attach replaces the connection and starts reading lines from it
+func (sp *SerialPort) attach(conn io.ReadWriteCloser) {
+	lines := make(chan string, 16)
+	sp.bufferMutex.Lock()
+	sp.ser = conn
+	sp.lines = lines
+	if sp.reads == nil {
+		sp.reads = make(chan registerValue, 16)
+	}
+	sp.bufferMutex.Unlock()
+	sp.wg.Add(1)
+	go func() {
+		defer sp.wg.Done()
+		sp.readLines(conn, lines)
+	}()
+}
+
+// detach closes the connection. Its reader stops without an error
+func (sp *SerialPort) detach() {
+	sp.bufferMutex.Lock()
+	conn := sp.ser
+	sp.ser = nil
+	sp.bufferMutex.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+func (sp *SerialPort) isAttached(conn io.ReadWriteCloser) bool {
+	sp.bufferMutex.Lock()
+	defer sp.bufferMutex.Unlock()
+	return !sp.closed && sp.ser == conn
+}
+
+// attachedReader retries empty reads from the connection while it is attached.
+// A serial port returns io.EOF when no data arrives within InterCharacterTimeout
+type attachedReader struct {
+	sp     *SerialPort
+	conn   io.ReadWriteCloser
+	serial bool
+}
+
+func (r *attachedReader) Read(b []byte) (int, error) {
+	for {
+		n, err := r.conn.Read(b)
+		if r.serial && n == 0 && err == io.EOF {
+			err = nil
+		}
+		if 0 < n || err != nil {
+			return n, err
+		}
+		if !r.sp.isAttached(r.conn) {
+			return 0, io.EOF
+		}
+	}
+}
+
+func (sp *SerialPort) readLines(conn io.ReadWriteCloser, lines chan string) {
+	reader := bufio.NewReaderSize(&attachedReader{sp, conn, IsSerialDevice(sp.deviceName)}, 2048)
+	for {
+		line, _, err := reader.ReadLine()
+		if !sp.isAttached(conn) {
+			return
+		}
+		if err == io.EOF {
+			err = fmt.Errorf("Connection closed by the bridge")
+		}
+		if err != nil {
+			sp.bufferMutex.Lock()
+			sp.broken = true
+			sp.bufferMutex.Unlock()
+			sp.report(errors.WithStack(err))
+			close(lines)
+			return
+		}
+		s := string(line)
+		if s == "" {
+			continue
+		}
+		if s[0] == '=' {
+			readBytes, err := strconv.Atoi(s[1:])
+			if err == nil {
+				sp.bufferMutex.Lock()
+				sp.sendable += readBytes
+				sp.bufferMutex.Unlock()
+				sp.kick()
+			}
+			continue
+		}
+		if s[0] == '+' || s[0] == '!' {
+			seq, err := strconv.Atoi(s[1:])
+			if err == nil {
+				sp.bufferMutex.Lock()
+				if s[0] == '+' {
+					sp.ackFrames(byte(seq))
+				} else {
+					log.Debugf("NAK #%d", seq)
+					sp.ackFrames(byte(seq - 1))
+					sp.resend = true
+				}
+				sp.bufferMutex.Unlock()
+				sp.kick()
+			}
+			continue
+		}
+		if strings.HasPrefix(s, "reg ") {
+			var r registerValue
+			_, err := fmt.Sscanf(s, "reg %d %d", &r.addr, &r.value)
+			if err == nil {
+				select {
+				case sp.reads <- r:
+				default:
 				}
-				if err != nil {
-					log.Warnf("Serial port error: " + err.Error())
+			}
+			continue
+		}
+		log.Debugf("IN: %s", s)
+		select {
+		case lines <- s:
+		default:
+		}
+	}
+}
+
+// handshake waits for the banner of the sketch and resets the session with hello,
+// so that the sketch starts from a clean state even if the previous session was interrupted
+func (sp *SerialPort) handshake() error {
+	helloSent := false
+	helloAcked := false
+	querySent := false
+	window := ARDUINO_BUFFER_SIZE
+	retry := 0
+	timeout := time.After(bannerTimeout)
+	for {
+		select {
+		case s, ok := <-sp.lines:
+			if !ok {
+				return fmt.Errorf("Connection closed by the bridge")
+			}
+			switch {
+			case s == "hello":
+				helloAcked = helloSent
+			case strings.HasPrefix(s, "version "):
+				sp.sketchVersion, _ = strconv.Atoi(s[8:])
+			case strings.HasPrefix(s, "buffer "):
+				// The sketch reports credits for the bytes consumed from its ring buffer of this size
+				window, _ = strconv.Atoi(s[7:])
+			case s == "ready":
+				if !(SKETCH_VERSION_GTE <= sp.sketchVersion && sp.sketchVersion < SKETCH_VERSION_LT) {
+					return &SketchVersionError{Version: sp.sketchVersion}
 				}
-				s := string(line)
-				if s == "" {
-					continue
+				if helloAcked || sp.sketchVersion < SKETCH_VERSION_HELLO {
+					// The sketch has initialized the chip
+					sp.invalidateRegisters()
+					sp.bufferMutex.Lock()
+					defer sp.bufferMutex.Unlock()
+					sp.window = window
+					sp.sendable = window
+					log.Debugf("window %d bytes", window)
+					return nil
 				}
-				if s[0] == '=' {
-					readBytes, err := strconv.Atoi(s[1:])
-					if err == nil {
-						sp.sendable += readBytes
+				if !helloSent {
+					// The sketch has just booted. Reset it anyway to make sure the state is clean
+					helloSent = true
+					timeout = time.After(helloTimeout)
+					if err := sp.sendControl(helloSequence); err != nil {
+						return err
 					}
-					continue
 				}
-				log.Debugf("IN: %s", s)
-				if wait == nil {
-					continue
-				}
-				if s == "ready" {
-					if !(SKETCH_VERSION_GTE <= sp.sketchVersion && sp.sketchVersion < SKETCH_VERSION_LT) {
-						wait <- fmt.Errorf(
-							`Sketch version mismatch (want %d <= version < %d, got %d). Please rewrite "bridge/bridge.ino" onto Arduino.`,
-							SKETCH_VERSION_GTE, SKETCH_VERSION_LT, sp.sketchVersion,
-						)
+			}
+		case <-timeout:
+			// No banner because the sketch is still running the previous session
+			switch {
+			case SKETCH_VERSION_HELLO <= sp.sketchVersion:
+				if helloSent {
+					retry++
+					if maxHelloRetries < retry {
+						return fmt.Errorf("No response from the bridge")
 					}
-					close(wait)
-					wait = nil
-				} else if 8 < len(s) && s[:8] == "version " {
-					sp.sketchVersion, _ = strconv.Atoi(s[8:])
+					log.Debugf("resending hello")
+				}
+				helloSent = true
+				timeout = time.After(helloTimeout)
+				if err := sp.sendControl(helloSequence); err != nil {
+					return err
 				}
+			case sp.sketchVersion == 0 && !sp.passive && !querySent:
+				// The version is unknown. Ask for the banner with a sequence which is harmless to older sketches
+				log.Debugf("querying the version")
+				querySent = true
+				timeout = time.After(helloTimeout)
+				if err := sp.sendControl(versionQuery); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("No response from the bridge")
 			}
-		}()
-		err = <-wait
-		if err != nil {
-			return nil, errors.WithStack(err)
 		}
 	}
-	return sp, nil
 }
 
-func (sp *SerialPort) Close() {
-	sp.closed = true
-	if sp.ser != nil {
-		log.Infof("closing serial port")
-		sp.ser.Close()
-		log.Infof("done")
+// sendControl writes the control sequence directly, bypassing the send queue
+func (sp *SerialPort) sendControl(b []byte) error {
+	sp.bufferMutex.Lock()
+	defer sp.bufferMutex.Unlock()
+	_, err := sp.ser.Write(b)
+	return errors.WithStack(err)
+}
+
+// writeRaw writes the bytes directly, bypassing the send queue
+func (sp *SerialPort) writeRaw(b []byte) error {
+	sp.bufferMutex.Lock()
+	defer sp.bufferMutex.Unlock()
+	_, err := sp.ser.Write(b)
+	sp.sendable -= len(b)
+	return errors.WithStack(err)
+}
+
+// request writes the command directly and waits for the reply line which starts with prefix
+func (sp *SerialPort) request(command []byte, prefix string) (string, error) {
+	err := sp.writeRaw(command)
+	if err != nil {
+		return "", err
 	}
-	sp.ser = nil
+	timeout := time.After(requestTimeout)
+	for {
+		select {
+		case s, ok := <-sp.lines:
+			if !ok {
+				return "", fmt.Errorf("Connection closed by the bridge")
+			}
+			if strings.HasPrefix(s, prefix) {
+				return s, nil
+			}
+		case <-timeout:
+			return "", fmt.Errorf("No reply from the bridge")
+		}
+	}
+}
+
+// negotiateProtocol2 switches the sketch into protocol v2, or keeps protocol v1 if it does not respond
+func (sp *SerialPort) negotiateProtocol2() {
+	_, err := sp.request(protocol2Switch, "protocol 2")
+	if err != nil {
+		log.Warnf("Sketch did not respond to protocol v2, falling back to v1: %s", err.Error())
+		return
+	}
+	sp.bufferMutex.Lock()
+	defer sp.bufferMutex.Unlock()
+	sp.protocol = 2
+	sp.sendable = sp.window
+}
+
+// negotiateBaudRate switches the baud rate of both the sketch and the port.
+// If the new rate does not work, the port is reconnected at DefaultBaudRate
+func (sp *SerialPort) negotiateBaudRate(want int) error {
+	if sp.sketchVersion < SKETCH_VERSION_BAUD {
+		log.Warnf("Sketch version %d cannot change the baud rate, using %d", sp.sketchVersion, DefaultBaudRate)
+		return nil
+	}
+	line, err := sp.request(baudQuery, "bauds")
+	if err != nil {
+		log.Warnf("Cannot query baud rates: %s", err.Error())
+		return nil
+	}
+	rates := strings.Fields(line)[1:]
+	index := -1
+	for i, r := range rates {
+		if r == strconv.Itoa(want) {
+			index = i
+		}
+	}
+	if index < 0 {
+		log.Warnf("Sketch does not support %d baud (supported: %s), using %d", want, strings.Join(rates, ", "), DefaultBaudRate)
+		return nil
+	}
+	_, err = sp.request([]byte{0xFF, 0x81, byte(index)}, "baud ")
+	if err == nil {
+		err = sp.reopen(want)
+	}
+	if err == nil {
+		// The sketch goes back to DefaultBaudRate unless it receives a ping in time
+		for i := 0; i < 3; i++ {
+			_, err = sp.request(baudPing, "pong")
+			if err == nil {
+				sp.baudRate = want
+				log.Infof("switched to %d baud", want)
+				return nil
+			}
+		}
+	}
+	log.Warnf("Cannot communicate at %d baud, falling back to %d: %s", want, DefaultBaudRate, err.Error())
+	err = sp.reopen(DefaultBaudRate)
+	if err != nil {
+		return err
+	}
+	return sp.handshake()
+}
+
+// reopen opens the device again at the baud rate
+func (sp *SerialPort) reopen(baudRate int) error {
+	sp.detach()
+	conn, err := OpenTransport(sp.deviceName, baudRate)
+	if err != nil {
+		return err
+	}
+	sp.attach(conn)
+	return nil
+}
+
+// SketchVersion returns the version of the bridge sketch, or 0 if the device is not a bridge
+func (sp *SerialPort) SketchVersion() int {
+	return sp.sketchVersion
+}
+
+// Protocol returns the version of the protocol used to communicate with the sketch
+func (sp *SerialPort) Protocol() int {
+	return sp.protocol
+}
+
+// NewRecorder creates a port which only records commands instead of sending them to a device
+func NewRecorder() *SerialPort {
+	sp := &SerialPort{
+		deviceName: "--",
+		closed:     true,
+		recording:  true,
+		selectedCh: -1,
+		commands:   []Command{},
+		buffer:     []byte{},
+		errs:       make(chan error, 1),
+	}
+	sp.shadow.invalidate()
+	return sp
+}
+
+// Recorded returns the commands recorded by the port created with NewRecorder
+func (sp *SerialPort) Recorded() []Command {
+	sp.bufferMutex.Lock()
+	defer sp.bufferMutex.Unlock()
+	return append([]Command{}, sp.commands...)
 }
 
 func (sp *SerialPort) isNullDevice() bool {
 	return sp.deviceName == "/dev/null" || sp.deviceName == "--"
 }
 
+// Flush sends the queue as much as possible, and returns true if all commands are sent.
+// It also returns true if the port is closed or stopped by an error
 func (sp *SerialPort) Flush() bool {
 	sp.bufferMutex.Lock()
 	defer sp.bufferMutex.Unlock()
-	sp.flush()
-	return len(sp.buffer) == 0
+	if err := sp.flush(); err != nil {
+		sp.broken = true
+		sp.report(errors.WithStack(err))
+	}
+	if sp.closed || sp.broken {
+		return true
+	}
+	return len(sp.buffer) == 0 && len(sp.priority) == 0 && len(sp.unacked) == 0 && (sp.held || len(sp.commands) == 0)
 }
 
-func (sp *SerialPort) flush() {
-	if sp.closed {
-		return
+func (sp *SerialPort) flush() error {
+	if sp.closed || sp.broken {
+		return nil
 	}
-	if 0 < len(sp.commands) {
-		for _, c := range sp.commands {
-			sp.buffer = append(sp.buffer, c.Bytes()...)
+	defer sp.updateStarvation()
+	// Commands are serialized only as much as sendable, so that priority commands can be inserted at command boundary
+	for len(sp.buffer) < sp.sendable {
+		var c Command
+		if 0 < len(sp.priority) {
+			c = sp.priority[0]
+			sp.priority = sp.priority[1:]
+		} else if !sp.held && 0 < len(sp.commands) {
+			c = sp.commands[0]
+			sp.commands = sp.commands[1:]
+			sp.enqueuedAt = sp.enqueuedAt[1:]
+		} else {
+			break
 		}
-		sp.commands = []Command{}
+		b := c.Bytes()
+		sp.queuedBytes -= len(b)
+		sp.buffer = append(sp.buffer, b...)
+	}
+	if sp.protocol == 2 {
+		return sp.flushFramed()
 	}
 	l := len(sp.buffer)
 	if sp.sendable < l {
 		l = sp.sendable
 	}
 	if l <= 0 {
-		return
+		return nil
 	}
 	//log.Debugf("sending %d", l)
 	n, err := sp.ser.Write(sp.buffer[:l])
 	if err != nil {
-		panic(errors.WithStack(err))
+		return err
 	}
 	sp.buffer = sp.buffer[n:]
 	sp.sentTotal += n
-	sp.sendable -= n
+	if !sp.capturing {
+		sp.sendable -= n
+	}
 	//log.Debugf("sent %d sendable=%d", n, sp.sendable)
+	return nil
 }
 
-var sendCommandOnce sync.Once
-
 func (sp *SerialPort) sendCommand(c Command) {
-	sendCommandOnce.Do(func() {
-		ticker := time.NewTicker(8 * time.Millisecond)
-		// @todo stop goroutine
-		go func() {
-			for range ticker.C {
-				sp.Flush()
-			}
-		}()
-	})
+	if sp.recording {
+		sp.bufferMutex.Lock()
+		defer sp.bufferMutex.Unlock()
+		sp.commands = append(sp.commands, c)
+		return
+	}
 	sp.bufferMutex.Lock()
 	defer sp.bufferMutex.Unlock()
+	if sp.broken {
+		// Nothing is sent until Reconnect, which expects the state to be sent again
+		return
+	}
 	sp.commands = append(sp.commands, c)
+	sp.enqueuedAt = append(sp.enqueuedAt, time.Now())
+	sp.addQueued(len(c.Bytes()))
+}
+
+// kick makes the flusher send the queue without waiting for the next tick
+func (sp *SerialPort) kick() {
+	select {
+	case sp.flushNow <- struct{}{}:
+	default:
+	}
+}
+
+// Pause holds the send queue and silences all voices immediately
+func (sp *SerialPort) Pause() {
+	sp.bufferMutex.Lock()
+	defer sp.bufferMutex.Unlock()
+	sp.held = true
+	silence := []Command{
+		NewSPICommand1(ymf825.SequencerSetting.Addr, ymf825.AllOff),
+		&WaitCommand{Msec: 1},
+		NewSPICommand1(ymf825.SequencerSetting.Addr, 0),
+	}
+	for _, c := range silence {
+		sp.priority = append(sp.priority, c)
+		sp.addQueued(len(c.Bytes()))
+	}
+}
+
+// Resume restarts sending the queue held by Pause
+func (sp *SerialPort) Resume() {
+	sp.bufferMutex.Lock()
+	defer sp.bufferMutex.Unlock()
+	sp.held = false
+	// The held time is not a delay of the transmission
+	now := time.Now()
+	for i := range sp.enqueuedAt {
+		sp.enqueuedAt[i] = now
+	}
 }
 
+// SendWait sends a wait, which is merged into the last wait if possible and split by MaxWaitMsec
 func (sp *SerialPort) SendWait(msec int) {
-	new := true
+	if msec <= 0 {
+		return
+	}
 	sp.bufferMutex.Lock()
-	defer func() {
-		sp.bufferMutex.Unlock()
-		if new {
-			sp.sendCommand(&WaitCommand{Msec: msec})
+	if 0 < len(sp.commands) {
+		if last, ok := sp.commands[len(sp.commands)-1].(*WaitCommand); ok && !sp.broken {
+			add := MaxWaitMsec - last.Msec
+			if msec < add {
+				add = msec
+			}
+			n := len(last.Bytes())
+			last.Msec += add
+			msec -= add
+			// The merged wait keeps the time when its first part was queued, from which the lag is measured
+			if !sp.recording {
+				sp.addQueued(len(last.Bytes()) - n)
+			}
 		}
-	}()
-	if len(sp.commands) == 0 {
-		return
 	}
-	last, ok := sp.commands[len(sp.commands)-1].(*WaitCommand)
-	if !ok {
-		return
+	sp.bufferMutex.Unlock()
+	for 0 < msec {
+		m := msec
+		if MaxWaitMsec < m {
+			m = MaxWaitMsec
+		}
+		sp.sendCommand(&WaitCommand{Msec: m})
+		msec -= m
+	}
+}
+
+type registerValue struct {
+	addr  uint8
+	value uint8
+}
+
+// ReadRegister reads the register of YMF825 after the queued commands are sent
+func (sp *SerialPort) ReadRegister(addr uint8) (uint8, error) {
+	if sp.closed || sp.capturing || sp.sketchVersion < SKETCH_VERSION_READ {
+		return 0, fmt.Errorf("Cannot read registers from %s", sp.deviceName)
+	}
+	sp.sendCommand(&ReadCommand{Addr: addr})
+	timeout := time.After(readTimeout)
+	for {
+		select {
+		case r := <-sp.reads:
+			if r.addr == addr&0x7F {
+				return r.value, nil
+			}
+		case <-timeout:
+			return 0, fmt.Errorf("No reply to reading register #%d", addr)
+		}
+	}
+}
+
+// ReadChannelRegister reads a control register (#12..#19) of the voice
+func (sp *SerialPort) ReadChannelRegister(ch int, addr uint8) (uint8, error) {
+	sp.sendChannelSelect(ch)
+	return sp.ReadRegister(addr)
+}
+
+// SendChannelRegister writes a control register (#12..#19) of the voice as it is, even if it already has the value
+func (sp *SerialPort) SendChannelRegister(ch int, addr uint8, data byte) {
+	sp.sendChannelSelect(ch)
+	sp.send(addr, data)
+	if ymf825.IsPerVoice(addr) {
+		sp.updateShadow(sp.shadow.voice[ch&15][addr-firstVoiceRegister:], true, data)
 	}
-	last.Msec += msec
-	new = false
+}
+
+// SendCommands queues precompiled commands as they are
+func (sp *SerialPort) SendCommands(commands []Command) {
+	for _, c := range commands {
+		sp.sendCommand(c)
+	}
+	sp.invalidateRegisters()
 }
 
 func (sp *SerialPort) SendTerminate() {
 	sp.sendCommand(&TerminateCommand{})
+	sp.invalidateRegisters()
 }
 
 func (sp *SerialPort) sendData(addr uint8, data []byte) {
@@ -235,45 +767,34 @@ func (sp *SerialPort) send(addr uint8, data byte) {
 }
 
 func (sp *SerialPort) sendChannelSelect(ch int) {
-	// http://madscient.hatenablog.jp/entry/2017/08/13/013913
-	// レジスタ#11の下位4ビットに操作したいチャンネル番号を0～15で書き込むことで、
-	// レジスタ#12～20に対応するチャンネルのControl Registerが現れます。
-	//
-	// |I_ADR|W/R|D7 |D6 |D5 |D4 |D3       |D2       |D1       |D0       |Reset Value|
-	// |#11  |W/R|"0"|"0"|"0"|"0"|CRGD_VNO3|CRGD_VNO2|CRGD_VNO1|CRGD_VNO0|00H        |
-	//
-	// CRGD_VNO
-	//   The CRGD_VNO is used to specify a tone number.
-	//   Reset Conditions
-	//     1. When the power supplies are turned on (power-on reset).
-	//     2. When the hardware reset is applied (RST_N="L").
-	//     3. When the ALRST is set to "1".
-	if sp.selectedCh != ch {
-		sp.send(11, byte(ch&15))
-	}
+	sp.bufferMutex.Lock()
+	changed := sp.selectedCh != ch
 	sp.selectedCh = ch
+	sp.bufferMutex.Unlock()
+	if changed {
+		sp.send(ymf825.VoiceSelect.Addr, pack(ymf825.VoiceSelect, ch))
+	}
 }
 
 func (sp *SerialPort) SendAllOff() {
-	// https://github.com/yamaha-webmusic/ymf825board/blob/master/manual/fbd_spec2.md#sequencer-setting
-	sp.send(8, 0xF6)
+	sp.sendGlobal(ymf825.SequencerSetting, ymf825.AllOff)
 	sp.SendWait(1)
-	sp.send(8, 0x00)
+	sp.sendGlobal(ymf825.SequencerSetting, 0)
 }
 
 // 0<=v<64
 func (sp *SerialPort) SendMasterVolume(v int) {
-	sp.send(25, byte(v<<2))
+	sp.sendGlobal(ymf825.MasterVolume, pack(ymf825.MasterVolume, v))
 }
 
 // 0<=g<4
 func (sp *SerialPort) SendAnalogGain(g int) {
-	sp.send(3, byte(g))
+	sp.sendGlobal(ymf825.AnalogGain, pack(ymf825.AnalogGain, g))
 }
 
 // 0<=v<32
 func (sp *SerialPort) SendSeqVol(v int) {
-	sp.send(9, byte(v<<3))
+	sp.sendGlobal(ymf825.SequencerVolume, pack(ymf825.SequencerVolume, v, 0, 0))
 }
 
 func (sp *SerialPort) SendTones(data []*voice.VM35FMVoice) {
@@ -289,6 +810,10 @@ func (sp *SerialPort) SendTones(data []*voice.VM35FMVoice) {
 	//   The tone parameters are set by the number of tones set to the Header. The parameter consists of 30 bytes of data for one tone.
 	//   The data are transferred and assigned to the Tone parameter memory from Tone 0 in the order they are written;
 	//   therefore, parameters of an intermediate Tone number cannot be written first. For details of the tone parameters, see "Tone Parameter"(fbd_spec3.md).
+	//
+	// The format of Sequence Data is not disclosed in the public specification, so the built-in sequencer
+	// (#8 START, #9 SIZE, #23/#24 MS_S) is not used and no sequence data is sent here.
+	// Instead, the sketch executes the waits by itself, so timing depends on the serial link only when its buffer runs out.
 
 	log.Debugf("sending %d tones", len(data))
 	b := []byte{0x80 + byte(len(data))}
@@ -296,110 +821,61 @@ func (sp *SerialPort) SendTones(data []*voice.VM35FMVoice) {
 		b = append(b, voice.Bytes(true, true)...)
 	}
 	b = append(b, 0x80, 0x03, 0x81, 0x80)
-	sp.sendData(7, b)
+	sp.sendData(ymf825.ContentsData.Addr, b)
 }
 
 // 0<=vib<8
 func (sp *SerialPort) SendVibrato(ch, vib int) {
-	// |I_ADR|W/R|D7 |D6    |D5    |D4    |D3    |D2    |D1   |D0    |Reset Value|
-	// |#17  |W  |"0"|"0"   |"0"   |"0"   |"0"   |XVB2  |XVB1 |XVB0  |00H        |
-	//
-	// XVB
-	//   The XVB is used to set a vibrato modulation.
-	//   This register is provided for each voice.
-	//   A setting value relatively acts on a DVB setting value of the voice parameter, as shown below.
-	//   When the calculation (add) result exceeds "3", "3"is used for the processing.
-	//     "0": OFF (reset value)
-	//     "1": 1 x (DVB value is used as is.)
-	//     "2": 2 x (DVB += 1)
-	//     "3": 2 x (DVB += 1)
-	//     "4": 4 x (DVB += 2)
-	//     "5": 4 x (DVB += 2)
-	//     "6": 8 x (DVB += 3)
-	//     "7": 8 x (DVB += 3)
 	if ch < 0 {
 		return
 	}
-	sp.sendChannelSelect(ch)
-	sp.send(17, byte(vib&7))
+	sp.sendVoice(ch, ymf825.Vibrato, vib)
 }
 
 // 0<=ChVol<32
 func (sp *SerialPort) SendVolume(ch, ChVol int, DIR_CV bool) {
-	// |I_ADR|W/R|D7 |D6    |D5    |D4    |D3    |D2    |D1 |D0    |Reset Value|
-	// |#16  |W  |"0"|ChVol4|ChVol3|ChVol2|ChVol1|ChVol0|"0"|DIR_CV|60H        |
-	//
-	// ChVol
-	//   This volume setting register is provided for each voice.
-	//   The interpolation function is provided for this volume setting register.
-	//   The relationship between setting values and volume gain values is the same as that of VoVol and SEQ_Vol. Reset Value is "18H" (-4.4 dB)
-	//
-	// DIR_CV
-	//   The DIR_CV controls the interpolation of the SEQ_Vol and ChVol.
-	//   This register is provided for each voice.
-	//   DIR_CV="1":
-	//     No interpolation in the SEQ_Vol and the ChVol# regardless of the DIR_SV and CHVOL_ITIME settings.
-	//   DIR_CV# = "0" (reset value):
-	//     The interpolation depends on the DIR_SV and CHVOL_ITIME settings.
 	if ch < 0 {
 		return
 	}
-	b := 0
-	if DIR_CV {
-		b = 1
-	}
-	sp.sendChannelSelect(ch)
-	sp.send(16, byte(ChVol&31<<2|b))
+	sp.sendVoice(ch, ymf825.ChannelVolume, ChVol, boolToInt(DIR_CV))
 }
 
 // 0<=INT<4 0<=FRAC<512
 func (sp *SerialPort) SendFineTune(ch, INT, FRAC int) {
-	// |I_ADR|W/R|D7 |D6   |D5   |D4   |D3   |D2   |D1   |D0   |Reset Value|
-	// |#18  |W  |"0"|"0"  |"0"  |INT1 |INT0 |FRAC8|FRAC7|FRAC6|08H        |
-	// |#19  |W  |"0"|FRAC5|FRAC4|FRAC3|FRAC2|FRAC1|FRAC0|"0"  |00H        |
-	//
-	// INT, FRAC
-	//   These registers specify a multiplier to the generated audio frequency. This number and frequency are proportional.
-	//   The INT is an integer part and FRAC is a fraction part.
-	//   These registers are provided for each voice.
-	//   Reset Value
-	//     INT : "01H"
-	//     FRAC: "000H"
 	if ch < 0 {
 		return
 	}
-	sp.sendChannelSelect(ch)
-	sp.send(18, byte(INT&3<<3|FRAC>>6&7))
-	sp.send(19, byte(FRAC&63<<1))
+	warnInvalid(ymf825.CheckFineTune(INT, FRAC))
+	hi, lo := ymf825.PackFineTune(INT, FRAC)
+	sp.sendVoicePair(ch, ymf825.FineTuneHigh, hi, lo)
 }
 
 func (sp *SerialPort) SendFineTuneByFloat(ch int, r float64) {
 	if ch < 0 {
 		return
 	}
-	r += .5 / 512.0
-	INT := int(math.Floor(r))
-	FRAC := int(math.Floor((r - float64(INT)) * 512))
+	INT, FRAC := fineTuneOf(r)
 	sp.SendFineTune(ch, INT, FRAC)
 }
 
+// fineTuneOf returns INT and FRAC nearest to the frequency multiplier
+func fineTuneOf(r float64) (INT, FRAC int) {
+	r += .5 / 512.0
+	INT = int(math.Floor(r))
+	FRAC = int(math.Floor((r - float64(INT)) * 512))
+	return
+}
+
 func (sp *SerialPort) SendKeyOn(ch int, note enums.Note, delta float64, VoVol, ToneNum int) {
-	// https://github.com/yamaha-webmusic/ymf825board/blob/master/manual/fbd_spec2.md#control-register-write-registers
-	//
-	// |I_ADR |W/R|D7 |D6    |D5    |D4    |D3       |D2       |D1       |D0       |Reset Value|
-	// |#12   |W  |"0"|VoVol4|VoVol3|VoVol2|VoVol1   |VoVol0   |"0"      |"0"      |60H        |
-	// |#13   |W  |"0"|"0"   |FNUM9 |FNUM8 |FNUM7    |BLOCK2   |BLOCK1   |BLOCK0   |00H        |
-	// |#14   |W  |"0"|FNUM6 |FNUM5 |FNUM4 |FNUM3    |FNUM2    |FNUM1    |FNUM0    |00H        |
-	// |#15   |W  |"0"|KeyOn |Mute  |EG_RST|ToneNum3 |ToneNum2 |ToneNum1 |ToneNum0 |00H        |
 	if ch < 0 {
 		return
 	}
 	f := note.Freq(delta)
-	sp.sendChannelSelect(ch)
-	sp.send(12, byte(VoVol&31<<2))
-	sp.send(13, byte((f.Fnum>>7&7)<<3|f.Block&7))
-	sp.send(14, byte(f.Fnum&127))
-	sp.send(15, 0x40|byte(ToneNum&15))
+	warnInvalid(ymf825.CheckFnum(f.Fnum, f.Block))
+	hi, lo := ymf825.PackFnum(f.Fnum, f.Block)
+	sp.sendVoice(ch, ymf825.VoiceVolume, VoVol)
+	sp.sendVoicePair(ch, ymf825.FnumHigh, hi, lo)
+	sp.sendVoice(ch, ymf825.KeyControl, 1, 0, 0, ToneNum)
 }
 
 func (sp *SerialPort) SendPitch(ch int, note enums.Note, delta float64) {
@@ -407,23 +883,33 @@ func (sp *SerialPort) SendPitch(ch int, note enums.Note, delta float64) {
 		return
 	}
 	f := note.Freq(delta)
-	sp.sendChannelSelect(ch)
-	sp.send(13, byte((f.Fnum>>7&7)<<3|f.Block&7))
-	sp.send(14, byte(f.Fnum&127))
+	warnInvalid(ymf825.CheckFnum(f.Fnum, f.Block))
+	hi, lo := ymf825.PackFnum(f.Fnum, f.Block)
+	sp.sendVoicePair(ch, ymf825.FnumHigh, hi, lo)
 }
 
 func (sp *SerialPort) SendKeyOff(ch, ToneNum int) {
 	if ch < 0 {
 		return
 	}
-	sp.sendChannelSelect(ch)
-	sp.send(15, byte(ToneNum&15))
+	sp.sendVoice(ch, ymf825.KeyControl, 0, 0, 0, ToneNum)
+}
+
+// Voices returns the number of voices which can be played at once
+func (sp *SerialPort) Voices() int {
+	return VoicesPerPort
 }
 
 func (sp *SerialPort) SendMuteAndEGReset(ch int) {
 	if ch < 0 {
 		return
 	}
-	sp.sendChannelSelect(ch)
-	sp.send(15, 0x30)
+	sp.sendVoice(ch, ymf825.KeyControl, 0, 1, 1, 0)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,135 @@
+package serial
+
+import (
+	"github.com/but80/smaf825/smaf/log"
+	"github.com/but80/smaf825/ymf825"
+)
+
+// shadowedGlobals are the global registers whose values are kept by shadowRegisters
+var shadowedGlobals = []*ymf825.Register{
+	ymf825.AnalogGain,
+	ymf825.SequencerSetting,
+	ymf825.SequencerVolume,
+	ymf825.MasterVolume,
+}
+
+const (
+	firstVoiceRegister = 12
+	lastVoiceRegister  = 19
+)
+
+// shadowRegisters holds the values last written to the registers of YMF825, or -1 if unknown
+type shadowRegisters struct {
+	global [26]int
+	voice  [16][lastVoiceRegister - firstVoiceRegister + 1]int
+}
+
+// invalidate forgets all values, e.g. after the chip is initialized by the sketch
+func (s *shadowRegisters) invalidate() {
+	for i := range s.global {
+		s.global[i] = -1
+	}
+	for ch := range s.voice {
+		for i := range s.voice[ch] {
+			s.voice[ch][i] = -1
+		}
+	}
+}
+
+func isShadowedGlobal(r *ymf825.Register) bool {
+	for _, g := range shadowedGlobals {
+		if g == r {
+			return true
+		}
+	}
+	return false
+}
+
+// updateShadow stores the values into the registers of the shadow starting at regs[0],
+// and returns false if all of them already have the values. The suppressed bytes are counted then.
+// The shadow is guarded by bufferMutex, since Metrics and Reconnect may run on other goroutines
+func (sp *SerialPort) updateShadow(regs []int, force bool, values ...byte) bool {
+	sp.bufferMutex.Lock()
+	defer sp.bufferMutex.Unlock()
+	if !force {
+		same := true
+		for i, v := range values {
+			if regs[i] != int(v) {
+				same = false
+				break
+			}
+		}
+		if same {
+			sp.suppressed += 2 * len(values)
+			return false
+		}
+	}
+	for i, v := range values {
+		regs[i] = int(v)
+	}
+	return true
+}
+
+// pack packs the values of the fields of the register.
+// Out of range values are reported, since Pack drops their excess bits and the chip gets another value
+func pack(r *ymf825.Register, values ...int) byte {
+	warnInvalid(r.Check(values...))
+	return r.Pack(values...)
+}
+
+func warnInvalid(err error) {
+	if err != nil {
+		log.Warnf("Invalid register value: %s", err.Error())
+	}
+}
+
+// sendGlobal writes a global register unless it already has the value
+func (sp *SerialPort) sendGlobal(r *ymf825.Register, data byte) {
+	addr := r.Addr
+	if !isShadowedGlobal(r) {
+		sp.send(addr, data)
+		return
+	}
+	if sp.updateShadow(sp.shadow.global[addr:], false, data) {
+		sp.send(addr, data)
+	}
+}
+
+// sendVoice writes the values of the fields to a control register (#12..#19) of the voice unless it already has them.
+// The channel is selected only when the write is actually sent
+func (sp *SerialPort) sendVoice(ch int, r *ymf825.Register, values ...int) {
+	addr, data := r.Addr, pack(r, values...)
+	i := addr - firstVoiceRegister
+	// KeyControl takes effect on every write
+	if sp.updateShadow(sp.shadow.voice[ch&15][i:], r == ymf825.KeyControl, data) {
+		sp.sendChannelSelect(ch)
+		sp.send(addr, data)
+	}
+}
+
+// sendVoicePair writes two successive control registers of the voice.
+// Both are written if either of them changes, since a multi-byte value like FNUM may take effect by the second write
+func (sp *SerialPort) sendVoicePair(ch int, r *ymf825.Register, data0, data1 byte) {
+	addr := r.Addr
+	i := addr - firstVoiceRegister
+	if sp.updateShadow(sp.shadow.voice[ch&15][i:], false, data0, data1) {
+		sp.sendChannelSelect(ch)
+		sp.send(addr, data0)
+		sp.send(addr+1, data1)
+	}
+}
+
+// invalidateRegisters forgets the shadow and the selected channel
+// when the registers may have been changed without them
+func (sp *SerialPort) invalidateRegisters() {
+	sp.bufferMutex.Lock()
+	defer sp.bufferMutex.Unlock()
+	sp.shadow.invalidate()
+	sp.selectedCh = -1
+}
+
+func (sp *SerialPort) addSuppressed(n int) {
+	sp.bufferMutex.Lock()
+	defer sp.bufferMutex.Unlock()
+	sp.suppressed += n
+}
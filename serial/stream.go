@@ -0,0 +1,188 @@
+package serial
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/but80/smaf825/ymf825"
+	"github.com/pkg/errors"
+)
+
+// StreamMagic is the signature at the beginning of a command stream file (.y825)
+const StreamMagic = "Y825"
+
+// StreamHeader is the header of a command stream file
+type StreamHeader struct {
+	Magic         [4]byte
+	SketchVersion uint16 // lowest version of bridge.ino which accepts all the commands
+	Volume        uint8  // initial master volume
+	Gain          uint8  // initial analog gain
+	SeqVol        uint8  // initial sequencer volume
+	Reserved      [3]byte
+}
+
+// Stream is a command sequence precompiled for the device
+type Stream struct {
+	Header   StreamHeader
+	Commands []Command
+}
+
+// NewStream creates a stream of the commands, which is made for the sketch versions accepting all of them
+func NewStream(volume, gain, seqvol int, commands []Command) *Stream {
+	s := &Stream{
+		Header: StreamHeader{
+			SketchVersion: uint16(RequiredSketchVersion(commands)),
+			Volume:        uint8(volume),
+			Gain:          uint8(gain),
+			SeqVol:        uint8(seqvol),
+		},
+		Commands: commands,
+	}
+	copy(s.Header.Magic[:], StreamMagic)
+	return s
+}
+
+// RequiredSketchVersion returns the lowest sketch version which accepts all the commands
+func RequiredSketchVersion(commands []Command) int {
+	for _, c := range commands {
+		if _, ok := c.(*ReadCommand); ok {
+			return SKETCH_VERSION_READ
+		}
+	}
+	return SKETCH_VERSION_GTE
+}
+
+// IsCompatible returns true if the stream can be sent to the current sketch
+func (s *Stream) IsCompatible() bool {
+	v := int(s.Header.SketchVersion)
+	return SKETCH_VERSION_GTE <= v && v < SKETCH_VERSION_LT
+}
+
+// Retune multiplies the fine tune written to each voice by the ratio, and returns the number of the writes changed.
+// A pair of FineTuneHigh and FineTuneLow is written by successive commands, as SendFineTune does
+func (s *Stream) Retune(ratio float64) int {
+	n := 0
+	for i := 0; i+1 < len(s.Commands); i++ {
+		hi, ok1 := s.Commands[i].(*SPICommand)
+		lo, ok2 := s.Commands[i+1].(*SPICommand)
+		if !ok1 || !ok2 || hi.Addr != ymf825.FineTuneHigh.Addr || lo.Addr != ymf825.FineTuneLow.Addr || len(hi.Data) != 1 || len(lo.Data) != 1 {
+			continue
+		}
+		INT, FRAC := ymf825.UnpackFineTune(hi.Data[0], lo.Data[0])
+		INT, FRAC = fineTuneOf((float64(INT) + float64(FRAC)/512.0) * ratio)
+		h, l := ymf825.PackFineTune(INT, FRAC)
+		s.Commands[i] = NewSPICommand1(hi.Addr, h)
+		s.Commands[i+1] = NewSPICommand1(lo.Addr, l)
+		i++
+		n++
+	}
+	return n
+}
+
+func (s *Stream) Write(w io.Writer) error {
+	err := binary.Write(w, binary.BigEndian, &s.Header)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, c := range s.Commands {
+		_, err := w.Write(c.Bytes())
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// Save writes the stream to the file
+func (s *Stream) Save(file string) error {
+	fh, err := os.Create(file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	w := bufio.NewWriter(fh)
+	err = s.Write(w)
+	if err == nil {
+		err = errors.WithStack(w.Flush())
+	}
+	if err2 := fh.Close(); err == nil && err2 != nil {
+		err = errors.WithStack(err2)
+	}
+	return err
+}
+
+func (s *Stream) Read(r io.Reader) error {
+	err := binary.Read(r, binary.BigEndian, &s.Header)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if string(s.Header.Magic[:]) != StreamMagic {
+		return errors.Errorf("Not a command stream file")
+	}
+	s.Commands, err = ReadCommands(r)
+	return err
+}
+
+// LoadStream reads a command stream file
+func LoadStream(file string) (*Stream, error) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer fh.Close()
+	s := &Stream{}
+	err = s.Read(bufio.NewReader(fh))
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ReadCommands parses the bytes sent to the sketch into commands until EOF.
+// The commands parsed before an error are also returned
+func ReadCommands(r io.Reader) ([]Command, error) {
+	result := []Command{}
+	var b [3]byte
+	for {
+		_, err := io.ReadFull(r, b[:1])
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return result, errors.WithStack(err)
+		}
+		switch {
+		case b[0] == 0xFF:
+			_, err = io.ReadFull(r, b[1:3])
+			if err != nil {
+				return result, errors.Wrapf(err, "in wait command")
+			}
+			msec := int(b[1])<<8 | int(b[2])
+			if msec == 0xFFFF {
+				result = append(result, &TerminateCommand{})
+			} else if msec&0xFF80 == 0x8000 {
+				result = append(result, &ReadCommand{Addr: b[2]})
+			} else {
+				result = append(result, &WaitCommand{Msec: msec})
+			}
+		case b[0]&0x80 != 0:
+			_, err = io.ReadFull(r, b[1:3])
+			if err != nil {
+				return result, errors.Wrapf(err, "in burst write command")
+			}
+			data := make([]byte, int(b[1])<<8|int(b[2]))
+			_, err = io.ReadFull(r, data)
+			if err != nil {
+				return result, errors.Wrapf(err, "in burst write command")
+			}
+			result = append(result, NewSPICommand(b[0]&0x7F, data))
+		default:
+			_, err = io.ReadFull(r, b[1:2])
+			if err != nil {
+				return result, errors.Wrapf(err, "in write command")
+			}
+			result = append(result, NewSPICommand1(b[0], b[1]))
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package serial
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/jacobsa/go-serial/serial"
+	"github.com/pkg/errors"
+)
+
+// OpenTransport opens the connection to the bridge sketch.
+//
+//	tcp://host:port     TCP socket (e.g. ser2net)
+//	unix:///path        Unix domain socket
+//	pipe:               stdin and stdout of this process
+//	pipe:command args   stdin and stdout of the command
+//	other               serial port name
+func OpenTransport(deviceName string, baudRate int) (io.ReadWriteCloser, error) {
+	switch {
+	case strings.HasPrefix(deviceName, "tcp://"):
+		conn, err := net.Dial("tcp", deviceName[len("tcp://"):])
+		return conn, errors.WithStack(err)
+	case strings.HasPrefix(deviceName, "unix://"):
+		conn, err := net.Dial("unix", deviceName[len("unix://"):])
+		return conn, errors.WithStack(err)
+	case strings.HasPrefix(deviceName, "pipe:"):
+		args := strings.Fields(deviceName[len("pipe:"):])
+		if len(args) == 0 {
+			return newStdioPipe(), nil
+		}
+		return newCommandPipe(args)
+	}
+	ser, err := serial.Open(serial.OpenOptions{
+		PortName:              deviceName,
+		BaudRate:              uint(baudRate),
+		DataBits:              8,
+		StopBits:              1,
+		ParityMode:            serial.PARITY_EVEN,
+		InterCharacterTimeout: 100, // short so that Close does not wait long for the pending Read
+		MinimumReadSize:       0,
+	})
+	return ser, errors.WithStack(err)
+}
+
+// IsSerialDevice returns true if the device name is not a URI accepted by OpenTransport
+func IsSerialDevice(deviceName string) bool {
+	for _, prefix := range []string{"tcp://", "unix://", "pipe:", CaptureScheme} {
+		if strings.HasPrefix(deviceName, prefix) {
+			return false
+		}
+	}
+	return deviceName != "/dev/null" && deviceName != "--" && deviceName != AutoDevice
+}
+
+type stdioPipe struct {
+	*io.PipeReader
+}
+
+func newStdioPipe() *stdioPipe {
+	r, w := io.Pipe()
+	// Reading os.Stdin cannot be interrupted, so it is copied in another goroutine which exits after Close
+	go func() {
+		_, err := io.Copy(w, os.Stdin)
+		w.CloseWithError(err)
+	}()
+	return &stdioPipe{r}
+}
+
+func (p *stdioPipe) Write(b []byte) (int, error) {
+	return os.Stdout.Write(b)
+}
+
+// commandPipe talks with a child process, e.g. "ssh raspberrypi socat - /dev/ttyUSB0"
+type commandPipe struct {
+	cmd *exec.Cmd
+	io.Reader
+	io.WriteCloser
+}
+
+func newCommandPipe(args []string) (*commandPipe, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &commandPipe{cmd: cmd, Reader: r, WriteCloser: w}, nil
+}
+
+func (p *commandPipe) Close() error {
+	p.WriteCloser.Close()
+	return errors.WithStack(p.cmd.Wait())
+}
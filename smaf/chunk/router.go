@@ -0,0 +1,358 @@
+package chunk
+
+import (
+	"github.com/but80/smaf825/smaf/enums"
+	"github.com/but80/smaf825/smaf/log"
+)
+
+// ChannelRouter decides YMF825 voices (0..15, or more with several devices) to which the notes of SMAF channels are assigned.
+// Negative voice number means that the note is not played.
+type ChannelRouter interface {
+	// Build is called by AggregateUsage after the usage of channels and notes are aggregated
+	Build(c *ScoreTrackSequenceDataChunk, channelsToSplit []enums.Channel)
+	ChannelTo(orgCh enums.Channel, note enums.Note) int
+	ChannelsTo(orgCh enums.Channel) []int
+}
+
+type voiceReserver interface {
+	ReserveVoices(voices []int)
+}
+
+// DrumSplitRouter assigns each SMAF channel to the voice of the same number,
+// and splits the notes of channelsToSplit into unused voices
+type DrumSplitRouter struct {
+	// Voices is the number of the voices available, which is 16 if zero
+	Voices            int
+	NoteToChannel     map[enums.Channel]map[enums.Note]int
+	ChannelToChannels map[enums.Channel][]int
+	reserved          map[int]bool
+}
+
+// ReserveVoices excludes voices from the destination of split notes.
+// The reservation is cleared by Build, since the router may be reused for other songs
+func (r *DrumSplitRouter) ReserveVoices(voices []int) {
+	if r.reserved == nil {
+		r.reserved = map[int]bool{}
+	}
+	for _, v := range voices {
+		r.reserved[v] = true
+	}
+}
+
+func (r *DrumSplitRouter) Build(c *ScoreTrackSequenceDataChunk, channelsToSplit []enums.Channel) {
+	// @todo Check available channel count
+	voices := r.Voices
+	if voices <= 0 {
+		voices = 16
+	}
+	unusedChannels := []int{}
+	for v := 0; v < voices; v++ {
+		if (16 <= v || !c.IsChannelUsed[enums.Channel(v)]) && !r.reserved[v] {
+			unusedChannels = append(unusedChannels, v)
+		}
+	}
+	r.NoteToChannel = map[enums.Channel]map[enums.Note]int{}
+	r.ChannelToChannels = map[enums.Channel][]int{}
+	for _, ch := range channelsToSplit {
+		if !c.IsChannelUsed[ch] {
+			continue
+		}
+		r.NoteToChannel[ch] = map[enums.Note]int{}
+		r.ChannelToChannels[ch] = []int{int(ch)}
+		for note := range c.UsedNotes[ch] {
+			r.NoteToChannel[ch][note] = int(ch)
+		}
+		first := true
+		for note := range c.UsedNotes[ch] {
+			if first {
+				first = false
+				continue
+			}
+			if len(unusedChannels) == 0 {
+				log.Warnf("Too many drum notes (%d in Ch.%d). %s is ignored", len(c.UsedNotes[ch]), ch, note)
+				r.NoteToChannel[ch][note] = -1
+				c.IgnoredPC[c.lastPC[ch]|uint32(note)] = true
+			} else {
+				chTo := unusedChannels[0]
+				unusedChannels = unusedChannels[1:]
+				r.NoteToChannel[ch][note] = chTo
+				r.ChannelToChannels[ch] = append(r.ChannelToChannels[ch], chTo)
+			}
+		}
+	}
+	r.reserved = nil
+}
+
+func (r *DrumSplitRouter) ChannelTo(orgCh enums.Channel, note enums.Note) int {
+	if r.NoteToChannel[orgCh] == nil {
+		return int(orgCh)
+	}
+	return r.NoteToChannel[orgCh][note]
+}
+
+func (r *DrumSplitRouter) ChannelsTo(orgCh enums.Channel) []int {
+	if r.ChannelToChannels[orgCh] == nil {
+		return []int{int(orgCh)}
+	}
+	return r.ChannelToChannels[orgCh]
+}
+
+// ChannelMapRouter assigns the SMAF channels in Map to the specified voices, and the others by Base
+type ChannelMapRouter struct {
+	Base ChannelRouter
+	Map  map[enums.Channel]int
+}
+
+func (r *ChannelMapRouter) Build(c *ScoreTrackSequenceDataChunk, channelsToSplit []enums.Channel) {
+	split := []enums.Channel{}
+	for _, ch := range channelsToSplit {
+		if _, ok := r.Map[ch]; !ok {
+			split = append(split, ch)
+		}
+	}
+	if rsv, ok := r.Base.(voiceReserver); ok {
+		voices := []int{}
+		for _, v := range r.Map {
+			voices = append(voices, v)
+		}
+		rsv.ReserveVoices(voices)
+	}
+	r.Base.Build(c, split)
+}
+
+func (r *ChannelMapRouter) ChannelTo(orgCh enums.Channel, note enums.Note) int {
+	if v, ok := r.Map[orgCh]; ok {
+		return v
+	}
+	return r.Base.ChannelTo(orgCh, note)
+}
+
+func (r *ChannelMapRouter) ChannelsTo(orgCh enums.Channel) []int {
+	if v, ok := r.Map[orgCh]; ok {
+		return []int{v}
+	}
+	return r.Base.ChannelsTo(orgCh)
+}
+
+// NoteAllocator is a ChannelRouter which assigns the voices to each note while it is held.
+// ChannelTo and ChannelsTo return the voices of the notes being held
+type NoteAllocator interface {
+	ChannelRouter
+	// NoteOn assigns voices to the note and returns them. The voices already assigned are returned if the note is held
+	NoteOn(orgCh enums.Channel, note enums.Note) []int
+	// NoteOff releases the voices of the note and returns them
+	NoteOff(orgCh enums.Channel, note enums.Note) []int
+	// NoteVoices returns the voices of the note being held
+	NoteVoices(orgCh enums.Channel, note enums.Note) []int
+	// SetPan sets the panpot of the channel, which affects the voices assigned to the following notes
+	SetPan(orgCh enums.Channel, panpot int)
+	// Polyphonic returns true if the notes of the channel are assigned to separate voices
+	Polyphonic(orgCh enums.Channel) bool
+	// Clone returns an allocator with the same settings and no voices assigned
+	Clone() NoteAllocator
+}
+
+type poolNote struct {
+	ch   enums.Channel
+	note enums.Note
+}
+
+// PoolRouter shares all voices of the devices by all channels, and assigns each note a free voice of any device.
+// The voices are numbered through the devices of 16 voices each.
+// If no voice is free, the voice of the oldest note is taken over.
+// The channels in Map are fixed to the voices, which are excluded from the pool.
+// If Pan is set, the notes of the channels panned left are played by the first device,
+// the right ones by the last device, and the center ones by a voice of every device
+type PoolRouter struct {
+	// Voices is the number of the voices available, which is 16 if zero
+	Voices   int
+	Pan      bool
+	Map      map[enums.Channel]int
+	owners   []*poolNote // note played by each voice, or nil if free
+	started  []int       // when each voice is assigned to the current note, or released
+	clock    int
+	held     map[poolNote][]int
+	panpots  map[enums.Channel]int
+	reserved map[int]bool
+}
+
+var _ NoteAllocator = &PoolRouter{}
+
+func (r *PoolRouter) voices() int {
+	if r.Voices <= 0 {
+		return 16
+	}
+	return r.Voices
+}
+
+// Build releases all voices
+func (r *PoolRouter) Build(c *ScoreTrackSequenceDataChunk, channelsToSplit []enums.Channel) {
+	voices := r.voices()
+	r.owners = make([]*poolNote, voices)
+	r.started = make([]int, voices)
+	r.clock = 0
+	r.held = map[poolNote][]int{}
+	r.panpots = map[enums.Channel]int{}
+	r.reserved = map[int]bool{}
+	for _, v := range r.Map {
+		r.reserved[v] = true
+	}
+}
+
+// boards returns the ranges of the voices from which each voice of the note of the channel is chosen
+func (r *PoolRouter) boards(orgCh enums.Channel) [][2]int {
+	n := (r.voices() + 15) / 16
+	board := func(i int) [2]int {
+		end := (i + 1) * 16
+		if r.voices() < end {
+			end = r.voices()
+		}
+		return [2]int{i * 16, end}
+	}
+	if !r.Pan || n < 2 {
+		return [][2]int{{0, r.voices()}}
+	}
+	panpot, ok := r.panpots[orgCh]
+	if !ok {
+		panpot = 64
+	}
+	switch {
+	case panpot < 48:
+		return [][2]int{board(0)}
+	case 80 < panpot:
+		return [][2]int{board(n - 1)}
+	}
+	result := [][2]int{}
+	for i := 0; i < n; i++ {
+		result = append(result, board(i))
+	}
+	return result
+}
+
+// take chooses a voice in the range, which is the free one released the earliest, or the one of the oldest note
+func (r *PoolRouter) take(from, to int) int {
+	result, stolen := -1, -1
+	for v := from; v < to; v++ {
+		if r.reserved[v] {
+			continue
+		}
+		if r.owners[v] == nil {
+			if result < 0 || r.started[v] < r.started[result] {
+				result = v
+			}
+		} else if stolen < 0 || r.started[v] < r.started[stolen] {
+			stolen = v
+		}
+	}
+	if result < 0 && 0 <= stolen {
+		result = stolen
+		owner := *r.owners[stolen]
+		log.Debugf("Voice %d of Ch.%d %s is taken over", stolen, owner.ch, owner.note)
+		r.release(owner, stolen)
+	}
+	return result
+}
+
+// release removes the voice from the note
+func (r *PoolRouter) release(n poolNote, voice int) {
+	voices := []int{}
+	for _, v := range r.held[n] {
+		if v != voice {
+			voices = append(voices, v)
+		}
+	}
+	if len(voices) == 0 {
+		delete(r.held, n)
+	} else {
+		r.held[n] = voices
+	}
+	r.owners[voice] = nil
+	r.clock++
+	r.started[voice] = r.clock
+}
+
+func (r *PoolRouter) NoteOn(orgCh enums.Channel, note enums.Note) []int {
+	if v, ok := r.Map[orgCh]; ok {
+		return []int{v}
+	}
+	n := poolNote{ch: orgCh, note: note}
+	if voices, ok := r.held[n]; ok {
+		return voices
+	}
+	voices := []int{}
+	for _, b := range r.boards(orgCh) {
+		v := r.take(b[0], b[1])
+		if v < 0 {
+			continue
+		}
+		r.owners[v] = &n
+		r.clock++
+		r.started[v] = r.clock
+		voices = append(voices, v)
+	}
+	if len(voices) == 0 {
+		return voices
+	}
+	r.held[n] = voices
+	return voices
+}
+
+func (r *PoolRouter) NoteOff(orgCh enums.Channel, note enums.Note) []int {
+	if v, ok := r.Map[orgCh]; ok {
+		return []int{v}
+	}
+	n := poolNote{ch: orgCh, note: note}
+	voices := r.held[n]
+	for _, v := range voices {
+		r.release(n, v)
+	}
+	return voices
+}
+
+func (r *PoolRouter) NoteVoices(orgCh enums.Channel, note enums.Note) []int {
+	if v, ok := r.Map[orgCh]; ok {
+		return []int{v}
+	}
+	return r.held[poolNote{ch: orgCh, note: note}]
+}
+
+func (r *PoolRouter) SetPan(orgCh enums.Channel, panpot int) {
+	if r.panpots == nil {
+		r.panpots = map[enums.Channel]int{}
+	}
+	r.panpots[orgCh] = panpot
+}
+
+func (r *PoolRouter) Clone() NoteAllocator {
+	result := &PoolRouter{Voices: r.Voices, Pan: r.Pan, Map: r.Map}
+	result.Build(nil, nil)
+	return result
+}
+
+func (r *PoolRouter) Polyphonic(orgCh enums.Channel) bool {
+	_, ok := r.Map[orgCh]
+	return !ok
+}
+
+// ChannelTo returns the first voice of the note being held, or -1 if the note is not held
+func (r *PoolRouter) ChannelTo(orgCh enums.Channel, note enums.Note) int {
+	voices := r.NoteVoices(orgCh, note)
+	if len(voices) == 0 {
+		return -1
+	}
+	return voices[0]
+}
+
+// ChannelsTo returns the voices of the notes of the channel being held
+func (r *PoolRouter) ChannelsTo(orgCh enums.Channel) []int {
+	if v, ok := r.Map[orgCh]; ok {
+		return []int{v}
+	}
+	result := []int{}
+	for v, owner := range r.owners {
+		if owner != nil && owner.ch == orgCh {
+			result = append(result, v)
+		}
+	}
+	return result
+}
@@ -0,0 +1,107 @@
+package chunk
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/but80/smaf825/smaf/enums"
+)
+
+func newPoolRouter(voices int, pan bool, m map[enums.Channel]int) *PoolRouter {
+	r := &PoolRouter{Voices: voices, Pan: pan, Map: m}
+	r.Build(&ScoreTrackSequenceDataChunk{}, nil)
+	return r
+}
+
+func TestPoolRouterAllocation(t *testing.T) {
+	r := newPoolRouter(32, false, nil)
+	used := map[int]bool{}
+	for i := 0; i < 32; i++ {
+		ch, note := enums.Channel(i%4), enums.Note(60+i)
+		voices := r.NoteOn(ch, note)
+		if len(voices) != 1 || used[voices[0]] {
+			t.Fatalf("note %d: got voices %v, want a free voice", i, voices)
+		}
+		used[voices[0]] = true
+		if again := r.NoteOn(ch, note); !reflect.DeepEqual(again, voices) {
+			t.Errorf("note %d: got voices %v for the held note, want %v", i, again, voices)
+		}
+		if v := r.ChannelTo(ch, note); v != voices[0] {
+			t.Errorf("note %d: ChannelTo returned %d, want %d", i, v, voices[0])
+		}
+	}
+	if n := len(r.ChannelsTo(1)); n != 8 {
+		t.Errorf("got %d voices of Ch.1, want 8", n)
+	}
+
+	// A released voice is reused after the voices released earlier
+	first := r.NoteOff(0, 60)
+	second := r.NoteOff(1, 61)
+	if got := r.NoteOn(5, 40); !reflect.DeepEqual(got, first) {
+		t.Errorf("got voices %v, want %v released first", got, first)
+	}
+	if got := r.NoteOn(5, 41); !reflect.DeepEqual(got, second) {
+		t.Errorf("got voices %v, want %v released second", got, second)
+	}
+	if got := r.ChannelTo(0, 60); got != -1 {
+		t.Errorf("ChannelTo returned %d for a released note, want -1", got)
+	}
+
+	// The voice of the oldest note is taken over when no voice is free
+	oldest := r.NoteVoices(2, 62)
+	if got := r.NoteOn(6, 50); !reflect.DeepEqual(got, oldest) {
+		t.Errorf("got voices %v, want %v of the oldest note", got, oldest)
+	}
+	if got := r.NoteVoices(2, 62); len(got) != 0 {
+		t.Errorf("got voices %v of the note taken over, want none", got)
+	}
+	if got := r.NoteOff(2, 62); len(got) != 0 {
+		t.Errorf("NoteOff returned %v for the note taken over, want none", got)
+	}
+}
+
+func TestPoolRouterMap(t *testing.T) {
+	r := newPoolRouter(16, false, map[enums.Channel]int{9: 0})
+	if r.Polyphonic(9) || !r.Polyphonic(0) {
+		t.Errorf("Polyphonic(9) = %v, Polyphonic(0) = %v", r.Polyphonic(9), r.Polyphonic(0))
+	}
+	for i := 0; i < 20; i++ {
+		voices := r.NoteOn(enums.Channel(i%8), enums.Note(60+i))
+		if len(voices) != 1 || voices[0] == 0 {
+			t.Fatalf("note %d: got voices %v, want one other than the mapped voice 0", i, voices)
+		}
+	}
+	for _, got := range [][]int{r.NoteOn(9, 36), r.NoteOn(9, 38), r.NoteOff(9, 36), r.ChannelsTo(9)} {
+		if !reflect.DeepEqual(got, []int{0}) {
+			t.Errorf("got voices %v of the mapped channel, want [0]", got)
+		}
+	}
+}
+
+func TestPoolRouterPan(t *testing.T) {
+	r := newPoolRouter(48, true, nil)
+	r.SetPan(0, 0)
+	r.SetPan(1, 127)
+	for i := 0; i < 20; i++ {
+		left := r.NoteOn(0, enums.Note(i))
+		if len(left) != 1 || 16 <= left[0] {
+			t.Fatalf("got voices %v for the left, want one in the first device", left)
+		}
+		right := r.NoteOn(1, enums.Note(i))
+		if len(right) != 1 || right[0] < 32 {
+			t.Fatalf("got voices %v for the right, want one in the last device", right)
+		}
+	}
+	center := r.NoteOn(2, 60)
+	if len(center) != 3 {
+		t.Fatalf("got voices %v for the center, want one of each device", center)
+	}
+	for i, v := range center {
+		if v/16 != i {
+			t.Errorf("got voices %v for the center, want one of each device", center)
+		}
+	}
+	if got := r.NoteOff(2, 60); !reflect.DeepEqual(got, center) {
+		t.Errorf("NoteOff returned %v, want %v", got, center)
+	}
+}
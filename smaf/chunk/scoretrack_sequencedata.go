@@ -93,16 +93,21 @@ func MergeSequenceDataChunks(chunks []*ScoreTrackSequenceDataChunk) *ScoreTrackS
 }
 
 type ScoreTrackSequenceDataChunk struct {
-	*ChunkHeader      `json:"chunk_header"`
-	FormatType        enums.ScoreTrackFormatType           `json:"format_type"`
-	Events            []event.DurationEventPair            `json:"events"`
-	IsChannelUsed     map[enums.Channel]bool               `json:"-"`
-	UsedChannelCount  int                                  `json:"-"`
-	UsedNoteCount     map[enums.Channel]int                `json:"-"`
-	NoteToChannel     map[enums.Channel]map[enums.Note]int `json:"-"`
-	ChannelToChannels map[enums.Channel][]int              `json:"-"`
-	UsedPC            map[uint32]bool                      `json:"-"`
-	IgnoredPC         map[uint32]bool                      `json:"-"`
+	*ChunkHeader     `json:"chunk_header"`
+	FormatType       enums.ScoreTrackFormatType            `json:"format_type"`
+	Events           []event.DurationEventPair             `json:"events"`
+	IsChannelUsed    map[enums.Channel]bool                `json:"-"`
+	UsedChannelCount int                                   `json:"-"`
+	UsedNotes        map[enums.Channel]map[enums.Note]bool `json:"-"`
+	UsedNoteCount    map[enums.Channel]int                 `json:"-"`
+	UsedPC           map[uint32]bool                       `json:"-"`
+	IgnoredPC        map[uint32]bool                       `json:"-"`
+	Router           ChannelRouter                         `json:"-"`
+	// Deprecated: NoteToChannel is a copy of the routing of channelsToSplit made by AggregateUsage. Use ChannelTo instead
+	NoteToChannel map[enums.Channel]map[enums.Note]int `json:"-"`
+	// Deprecated: ChannelToChannels is a copy of the routing of channelsToSplit made by AggregateUsage. Use ChannelsTo instead
+	ChannelToChannels map[enums.Channel][]int `json:"-"`
+	lastPC            map[enums.Channel]uint32
 }
 
 func (c *ScoreTrackSequenceDataChunk) Traverse(fn func(Chunk)) {
@@ -177,7 +182,7 @@ func (c *ScoreTrackSequenceDataChunk) Read(rdr io.Reader) error {
 
 func (c *ScoreTrackSequenceDataChunk) AggregateUsage(channelsToSplit []enums.Channel) {
 	c.IsChannelUsed = map[enums.Channel]bool{}
-	usedNotes := map[enums.Channel]map[enums.Note]bool{}
+	c.UsedNotes = map[enums.Channel]map[enums.Note]bool{}
 	c.UsedPC = map[uint32]bool{}
 	pc := map[enums.Channel]uint32{}
 	for _, e := range c.Events {
@@ -194,61 +199,42 @@ func (c *ScoreTrackSequenceDataChunk) AggregateUsage(channelsToSplit []enums.Cha
 			pc[ch] = pc[ch]&0xFFFF00FF | uint32(evt.PC)<<8
 		case *event.NoteEvent:
 			c.IsChannelUsed[ch] = true
-			if usedNotes[ch] == nil {
-				usedNotes[ch] = map[enums.Note]bool{}
+			if c.UsedNotes[ch] == nil {
+				c.UsedNotes[ch] = map[enums.Note]bool{}
 			}
-			usedNotes[ch][evt.Note] = true
+			c.UsedNotes[ch][evt.Note] = true
 			c.UsedPC[pc[ch]] = true
 		}
 	}
-	// @todo Check available channel count
-	unusedChannels := []enums.Channel{}
-	for ch := enums.Channel(0); ch < 16; ch++ {
-		if !c.IsChannelUsed[ch] {
-			unusedChannels = append(unusedChannels, ch)
-		}
-	}
+	c.lastPC = pc
 	//
 	c.UsedChannelCount = 0
 	for range c.IsChannelUsed {
 		c.UsedChannelCount++
 	}
 	c.UsedNoteCount = map[enums.Channel]int{}
-	for ch, n := range usedNotes {
+	for ch, n := range c.UsedNotes {
 		for range n {
 			c.UsedNoteCount[ch]++
 		}
 	}
 	//
+	c.IgnoredPC = map[uint32]bool{}
+	if c.Router == nil {
+		c.Router = &DrumSplitRouter{}
+	}
+	c.Router.Build(c, channelsToSplit)
 	c.NoteToChannel = map[enums.Channel]map[enums.Note]int{}
 	c.ChannelToChannels = map[enums.Channel][]int{}
-	c.IgnoredPC = map[uint32]bool{}
 	for _, ch := range channelsToSplit {
 		if !c.IsChannelUsed[ch] {
 			continue
 		}
 		c.NoteToChannel[ch] = map[enums.Note]int{}
-		c.ChannelToChannels[ch] = []int{int(ch)}
-		for note := range usedNotes[ch] {
-			c.NoteToChannel[ch][note] = int(ch)
-		}
-		first := true
-		for note := range usedNotes[ch] {
-			if first {
-				first = false
-				continue
-			}
-			if len(unusedChannels) == 0 {
-				log.Warnf("Too many drum notes (%d in Ch.%d). %s is ignored", len(usedNotes[ch]), ch, note)
-				c.NoteToChannel[ch][note] = -1
-				c.IgnoredPC[pc[ch]|uint32(note)] = true
-			} else {
-				chTo := int(unusedChannels[0])
-				unusedChannels = unusedChannels[1:]
-				c.NoteToChannel[ch][note] = chTo
-				c.ChannelToChannels[ch] = append(c.ChannelToChannels[ch], chTo)
-			}
+		for note := range c.UsedNotes[ch] {
+			c.NoteToChannel[ch][note] = c.Router.ChannelTo(ch, note)
 		}
+		c.ChannelToChannels[ch] = c.Router.ChannelsTo(ch)
 	}
 }
 
@@ -258,15 +244,15 @@ func (c *ScoreTrackSequenceDataChunk) IsIgnoredPC(bankMSB, bankLSB, PC int, drum
 }
 
 func (c *ScoreTrackSequenceDataChunk) ChannelTo(orgCh enums.Channel, note enums.Note) int {
-	if c.NoteToChannel[orgCh] == nil {
+	if c.Router == nil {
 		return int(orgCh)
 	}
-	return c.NoteToChannel[orgCh][note]
+	return c.Router.ChannelTo(orgCh, note)
 }
 
 func (c *ScoreTrackSequenceDataChunk) ChannelsTo(orgCh enums.Channel) []int {
-	if c.ChannelToChannels[orgCh] == nil {
+	if c.Router == nil {
 		return []int{int(orgCh)}
 	}
-	return c.ChannelToChannels[orgCh]
+	return c.Router.ChannelsTo(orgCh)
 }
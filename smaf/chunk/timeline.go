@@ -0,0 +1,274 @@
+package chunk
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/but80/smaf825/smaf/enums"
+	"github.com/but80/smaf825/smaf/event"
+	"github.com/pkg/errors"
+)
+
+// TimelineEvent is an event placed at the absolute time
+type TimelineEvent struct {
+	Msec    int           `json:"msec"`
+	NoteOff int           `json:"note_off"` // time when the note is turned off, or -1 if the event is not a note or its gate time is 0
+	Channel enums.Channel `json:"channel"`  // SMAF channel after merging all sequence data chunks
+	Voices  []int         `json:"voices"`   // YMF825 voices given by the router of the sequence, or nil without a router
+	BankMSB int           `json:"bank_msb"`
+	BankLSB int           `json:"bank_lsb"`
+	PC      int           `json:"pc"`
+	Event   event.Event   `json:"event"`
+}
+
+func (e *TimelineEvent) String() string {
+	s := fmt.Sprintf("%8d ms  Ch.%02d @%d:%d:%d  %s", e.Msec, e.Channel, e.BankMSB, e.BankLSB, e.PC, e.Event.String())
+	if e.Voices != nil {
+		s += fmt.Sprintf("  voices %v", e.Voices)
+	}
+	if 0 <= e.NoteOff {
+		s += fmt.Sprintf(" -> %d ms", e.NoteOff)
+	}
+	return s
+}
+
+// Timeline is the list of all events in a file sorted by the absolute time
+type Timeline struct {
+	Events []TimelineEvent `json:"events"`
+	Length int             `json:"length"` // time of the last event (msec)
+}
+
+type timelineProgram struct {
+	bankMSB, bankLSB, pc int
+}
+
+// NewTimeline builds a timeline from all sequence data chunks in the file.
+// The chunks are not modified
+func NewTimeline(c *FileChunk) (*Timeline, error) {
+	var score *ScoreTrackChunk
+	type track struct {
+		sequence         *ScoreTrackSequenceDataChunk
+		durationTimeBase int
+		gateTimeBase     int
+	}
+	tracks := []track{}
+	c.Traverse(func(c Chunk) {
+		switch ck := c.(type) {
+		case *ScoreTrackChunk:
+			score = ck
+		case *ScoreTrackSequenceDataChunk:
+			t := track{sequence: ck, durationTimeBase: 20, gateTimeBase: 20}
+			if score != nil {
+				t.durationTimeBase = score.DurationTimeBase
+				t.gateTimeBase = score.GateTimeBase
+			}
+			tracks = append(tracks, t)
+		}
+	})
+	if len(tracks) == 0 {
+		return nil, errors.Errorf("Sequence data chunk not found")
+	}
+	result := &Timeline{Events: []TimelineEvent{}}
+	for i, t := range tracks {
+		shift := 0
+		if 1 < len(tracks) {
+			shift = i * 4 // same as MergeSequenceDataChunks
+		}
+		result.append(t.sequence, shift, t.durationTimeBase, t.gateTimeBase, nil)
+	}
+	sort.SliceStable(result.Events, func(i, j int) bool {
+		return result.Events[i].Msec < result.Events[j].Msec
+	})
+	return result, nil
+}
+
+// NewSequenceTimeline builds a timeline from a sequence data chunk, such as the result of MergeSequenceDataChunks.
+// The events are in the same order as c.Events, and their voices are resolved by c.Router if it is set.
+// A NoteAllocator is run over the events on its clone, assuming that all notes are played from the beginning
+// with the panpots at the center
+func NewSequenceTimeline(c *ScoreTrackSequenceDataChunk, durationTimeBase, gateTimeBase int) *Timeline {
+	result := &Timeline{Events: make([]TimelineEvent, 0, len(c.Events))}
+	router := c.Router
+	alloc, ok := router.(NoteAllocator)
+	if ok {
+		router = nil
+	}
+	result.append(c, 0, durationTimeBase, gateTimeBase, router)
+	if ok {
+		result.allocate(alloc.Clone())
+	}
+	return result
+}
+
+type timelineNote struct {
+	ch      enums.Channel
+	note    enums.Note
+	noteOff int
+}
+
+// allocate resolves the voices of the events by the allocator in the same order as the sequencer.
+// The notes turned off by the time of an event are released before it,
+// and a note of a monophonic channel releases the other notes of the channel
+func (t *Timeline) allocate(alloc NoteAllocator) {
+	held := []timelineNote{}
+	release := func(i int) {
+		alloc.NoteOff(held[i].ch, held[i].note)
+		held = append(held[:i], held[i+1:]...)
+	}
+	mono := map[enums.Channel]bool{}
+	for i := range t.Events {
+		e := &t.Events[i]
+		for {
+			next := -1
+			for j, n := range held {
+				if 0 <= n.noteOff && n.noteOff <= e.Msec && (next < 0 || n.noteOff < held[next].noteOff) {
+					next = j
+				}
+			}
+			if next < 0 {
+				break
+			}
+			release(next)
+		}
+		switch evt := e.Event.(type) {
+		case *event.ControlChangeEvent:
+			switch evt.CC {
+			case enums.CC_Panpot:
+				alloc.SetPan(e.Channel, evt.Value)
+			case enums.CC_MonoOn:
+				mono[e.Channel] = true
+			case enums.CC_PolyOn:
+				mono[e.Channel] = false
+			}
+		case *event.NoteEvent:
+			poly := !mono[e.Channel] && alloc.Polyphonic(e.Channel)
+			for j := len(held) - 1; 0 <= j; j-- {
+				if held[j].ch != e.Channel {
+					continue
+				}
+				if held[j].note == evt.Note {
+					// Retriggered with the voices already assigned
+					held = append(held[:j], held[j+1:]...)
+				} else if !poly {
+					release(j)
+				}
+			}
+			e.Voices = append([]int{}, alloc.NoteOn(e.Channel, evt.Note)...)
+			held = append(held, timelineNote{ch: e.Channel, note: evt.Note, noteOff: e.NoteOff})
+			continue
+		}
+		e.Voices = alloc.ChannelsTo(e.Channel)
+	}
+}
+
+// append appends the events of the sequence with their channels shifted
+func (t *Timeline) append(c *ScoreTrackSequenceDataChunk, shift, durationTimeBase, gateTimeBase int, router ChannelRouter) {
+	programs := map[enums.Channel]*timelineProgram{}
+	msec := 0
+	for _, pair := range c.Events {
+		msec += pair.Duration * durationTimeBase
+		ch := pair.Event.GetChannel() + enums.Channel(shift)
+		p, ok := programs[ch]
+		if !ok {
+			p = &timelineProgram{}
+			programs[ch] = p
+		}
+		noteOff := -1
+		var voices []int
+		if router != nil {
+			voices = router.ChannelsTo(ch)
+		}
+		switch evt := pair.Event.(type) {
+		case *event.ControlChangeEvent:
+			switch evt.CC {
+			case enums.CC_BankSelectMSB:
+				p.bankMSB = evt.Value
+			case enums.CC_BankSelectLSB:
+				p.bankLSB = evt.Value
+			}
+		case *event.ProgramChangeEvent:
+			p.pc = evt.PC
+		case *event.NoteEvent:
+			if 0 < evt.GateTime {
+				noteOff = msec + evt.GateTime*gateTimeBase
+			}
+			if router != nil {
+				voices = []int{}
+				if v := router.ChannelTo(ch, evt.Note); 0 <= v {
+					voices = append(voices, v)
+				}
+			}
+		}
+		t.Events = append(t.Events, TimelineEvent{
+			Msec:    msec,
+			NoteOff: noteOff,
+			Channel: ch,
+			Voices:  voices,
+			BankMSB: p.bankMSB,
+			BankLSB: p.bankLSB,
+			PC:      p.pc,
+			Event:   pair.Event,
+		})
+		if t.Length < msec {
+			t.Length = msec
+		}
+	}
+}
+
+func (t *Timeline) String() string {
+	lines := []string{}
+	for i := range t.Events {
+		lines = append(lines, t.Events[i].String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Unroll returns a new timeline which repeats this timeline the given times.
+// Each repetition starts at the time of the last event of the previous one, as the sequencer loops
+func (t *Timeline) Unroll(loops int) *Timeline {
+	if loops < 1 {
+		loops = 1
+	}
+	result := &Timeline{
+		Events: make([]TimelineEvent, 0, len(t.Events)*loops),
+		Length: t.Length * loops,
+	}
+	for i := 0; i < loops; i++ {
+		offset := t.Length * i
+		for _, e := range t.Events {
+			e.Msec += offset
+			if 0 <= e.NoteOff {
+				e.NoteOff += offset
+			}
+			result.Events = append(result.Events, e)
+		}
+	}
+	return result
+}
+
+// Search returns the index of the first event at or after the time
+func (t *Timeline) Search(msec int) int {
+	return sort.Search(len(t.Events), func(i int) bool {
+		return msec <= t.Events[i].Msec
+	})
+}
+
+// Range returns the events fired in from <= time < to
+func (t *Timeline) Range(from, to int) []TimelineEvent {
+	if to <= from {
+		return []TimelineEvent{}
+	}
+	return t.Events[t.Search(from):t.Search(to)]
+}
+
+// NotesAt returns the note events sounding at the time
+func (t *Timeline) NotesAt(msec int) []TimelineEvent {
+	result := []TimelineEvent{}
+	for _, e := range t.Events[:t.Search(msec+1)] {
+		if _, ok := e.Event.(*event.NoteEvent); ok && msec < e.NoteOff {
+			result = append(result, e)
+		}
+	}
+	return result
+}
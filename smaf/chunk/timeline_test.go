@@ -0,0 +1,83 @@
+package chunk
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/but80/smaf825/smaf/enums"
+	"github.com/but80/smaf825/smaf/event"
+)
+
+func TestNewSequenceTimeline(t *testing.T) {
+	c := &ScoreTrackSequenceDataChunk{
+		Events: []event.DurationEventPair{
+			{Duration: 0, Event: &event.NoteEvent{Channel: 0, Note: 60, GateTime: 5}},
+			{Duration: 10, Event: &event.ControlChangeEvent{Channel: 9, CC: enums.CC_MainVolume, Value: 100}},
+			{Duration: 0, Event: &event.NoteEvent{Channel: 9, Note: 36, GateTime: 2}},
+			{Duration: 3, Event: &event.NoteEvent{Channel: 9, Note: 38, GateTime: 0}},
+		},
+	}
+	c.AggregateUsage([]enums.Channel{9})
+	tl := NewSequenceTimeline(c, 20, 10)
+
+	if len(tl.Events) != len(c.Events) {
+		t.Fatalf("got %d events, want %d", len(tl.Events), len(c.Events))
+	}
+	for i, want := range []struct{ msec, noteOff int }{{0, 50}, {200, -1}, {200, 220}, {260, -1}} {
+		e := tl.Events[i]
+		if e.Event != c.Events[i].Event || e.Msec != want.msec || e.NoteOff != want.noteOff {
+			t.Errorf("event %d: got %s, want %d ms -> %d ms", i, e.String(), want.msec, want.noteOff)
+		}
+	}
+	if tl.Length != 260 {
+		t.Errorf("got length %d, want 260", tl.Length)
+	}
+	// The notes of the drum channel are split into Ch.9 and the first unused voice
+	if !reflect.DeepEqual(tl.Events[0].Voices, []int{0}) {
+		t.Errorf("got voices %v for Ch.0, want [0]", tl.Events[0].Voices)
+	}
+	drums := append(append([]int{}, tl.Events[2].Voices...), tl.Events[3].Voices...)
+	sort.Ints(drums)
+	if !reflect.DeepEqual(drums, []int{1, 9}) {
+		t.Errorf("got voices %v for the drum notes, want [1 9]", drums)
+	}
+	cc := append([]int{}, tl.Events[1].Voices...)
+	sort.Ints(cc)
+	if !reflect.DeepEqual(cc, []int{1, 9}) {
+		t.Errorf("got voices %v for the control change of the drum channel, want [1 9]", cc)
+	}
+
+	c.Router = nil
+	for _, e := range NewSequenceTimeline(c, 20, 10).Events {
+		if e.Voices != nil {
+			t.Errorf("got voices %v without a router, want nil", e.Voices)
+		}
+	}
+}
+
+func TestNewSequenceTimelineAllocator(t *testing.T) {
+	c := &ScoreTrackSequenceDataChunk{
+		Events: []event.DurationEventPair{
+			{Duration: 0, Event: &event.NoteEvent{Channel: 0, Note: 60, GateTime: 5}},
+			{Duration: 0, Event: &event.NoteEvent{Channel: 1, Note: 64, GateTime: 10}},
+			{Duration: 3, Event: &event.NoteEvent{Channel: 0, Note: 62, GateTime: 5}},
+			{Duration: 0, Event: &event.NoteEvent{Channel: 0, Note: 65, GateTime: 5}},
+			{Duration: 0, Event: &event.ControlChangeEvent{Channel: 0, CC: enums.CC_MainVolume, Value: 100}},
+		},
+	}
+	router := &PoolRouter{Voices: 2}
+	c.Router = router
+	c.AggregateUsage([]enums.Channel{})
+	tl := NewSequenceTimeline(c, 20, 10)
+
+	// Ch.0 note 60 is released at 50 ms, and Ch.0 note 65 takes over the voice of the oldest note
+	for i, want := range [][]int{{0}, {1}, {0}, {1}, {0, 1}} {
+		if !reflect.DeepEqual(tl.Events[i].Voices, want) {
+			t.Errorf("event %d: got voices %v, want %v", i, tl.Events[i].Voices, want)
+		}
+	}
+	if v := router.ChannelsTo(0); len(v) != 0 {
+		t.Errorf("got voices %v held by the router of the sequence, want none", v)
+	}
+}
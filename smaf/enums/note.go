@@ -43,6 +43,9 @@ type NoteFreq struct {
 
 const (
 	Note_A3 = 9 + 12*3
+	// Range of notes which Freq can represent without clipping BLOCK and FNUM
+	Note_Min = 0
+	Note_Max = 114
 )
 
 func (n Note) String() string {
@@ -54,6 +57,18 @@ func (n Note) Name() string {
 	return fmt.Sprintf("%s%d", noteName[i%12], i/12-1)
 }
 
+// Transpose shifts the note by semitones, folding it back by octaves into the range between Note_Min and Note_Max
+func (n Note) Transpose(semitones int) Note {
+	t := n + Note(semitones)
+	for t < Note_Min {
+		t += 12
+	}
+	for Note_Max < t {
+		t -= 12
+	}
+	return t
+}
+
 var fnumK = math.Pow(2.0, 19.0) / 48000.0 / 2.0
 
 func (n Note) Freq(delta float64) NoteFreq {
@@ -89,3 +104,14 @@ func (n Note) Freq(delta float64) NoteFreq {
 		Fnum:  fnum,
 	}
 }
+
+// NoteFromFreq returns the nearest note and the difference from it in semitones, which is the inverse of Freq
+func NoteFromFreq(f NoteFreq) (Note, float64) {
+	if f.Fnum <= 0 {
+		return Note_Min, 0
+	}
+	hz := float64(f.Fnum) * math.Pow(2.0, float64(f.Block)) / fnumK
+	n := float64(Note_A3) + 12.0*math.Log2(hz/440.0)
+	note := math.Floor(n + .5)
+	return Note(note), n - note
+}
@@ -25,6 +25,9 @@ const (
 	VM35FMVoiceVersion_VM5
 )
 
+// YMF825ToneSize is the length of the bytes returned by VM35FMVoice.Bytes(true, true)
+const YMF825ToneSize = 30
+
 type VM35FMOperator struct {
 	Num     int                `json:"-"` // Operator number
 	Version VM35FMVoiceVersion `json:"-"`
@@ -46,8 +49,16 @@ type VM35FMOperator struct {
 	KSR     bool               `json:"ksr"`   // Key Scaling Rate
 	EAM     bool               `json:"eam"`   // Enable AM
 	EVB     bool               `json:"evb"`   // Enable Vibrato
+	// Reserved holds the bits which are not assigned to the fields above, to write them back as they are read
+	Reserved [7]byte `json:"-"`
 }
 
+// vm35FMOperatorReservedBits are the bits of VM35FMOperator which are marked "-"
+var vm35FMOperatorReservedBits = [7]byte{0x04, 0x00, 0x00, 0x00, 0x88, 0x08, 0x00}
+
+// vm35FMVoiceReservedBits are the bits of Global+1 and Global+2 of VM35FMVoice which are marked "-"
+var vm35FMVoiceReservedBits = [2]byte{0x04, 0x18}
+
 func (op *VM35FMOperator) Read(rdr io.Reader, rest *int) error {
 	//    | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
 	// +0 |      S R      |XOF| - |SUS|KSR|
@@ -83,6 +94,9 @@ func (op *VM35FMOperator) Read(rdr io.Reader, rest *int) error {
 	op.DT = int(data[5] & 7)
 	op.WS = int(data[6] >> 3)
 	op.FB = int(data[6] & 7)
+	for i := range data {
+		op.Reserved[i] = data[i] & vm35FMOperatorReservedBits[i]
+	}
 	return nil
 }
 
@@ -95,7 +109,7 @@ func (op *VM35FMOperator) Bytes(forYMF825 bool) []byte {
 			log.Warnf("Invalid wave shape %d", ws)
 		}
 	}
-	return []byte{
+	b := []byte{
 		byte(op.SR&15)<<4 | util.BoolToByte(op.XOF, 0x08) | util.BoolToByte(sus, 0x02) | util.BoolToByte(op.KSR, 0x01),
 		byte(op.RR&15)<<4 | byte(op.DR&15),
 		byte(op.AR&15)<<4 | byte(op.SL&15),
@@ -104,6 +118,12 @@ func (op *VM35FMOperator) Bytes(forYMF825 bool) []byte {
 		byte(op.MULTI&15)<<4 | byte(op.DT&7),
 		byte(ws)<<3 | byte(op.FB&7),
 	}
+	if !forYMF825 {
+		for i := range b {
+			b[i] |= op.Reserved[i] & vm35FMOperatorReservedBits[i]
+		}
+	}
+	return b
 }
 
 func (op *VM35FMOperator) String() string {
@@ -143,6 +163,8 @@ type VM35FMVoice struct {
 	PE        bool               `json:"pe"` // Panpot Enable (unused in YMF825)
 	ALG       enums.Algorithm    `json:"alg"`
 	Operators [4]*VM35FMOperator `json:"operators"`
+	// Reserved holds the bits of Global+1 and Global+2 which are not assigned to the fields above
+	Reserved [2]byte `json:"-"`
 }
 
 func NewVM35FMVoice(data []byte, version VM35FMVoiceVersion) (*VM35FMVoice, error) {
@@ -163,6 +185,25 @@ func NewVM35FMVoice(data []byte, version VM35FMVoiceVersion) (*VM35FMVoice, erro
 	return voice, nil
 }
 
+// NewVM35FMVoiceFromYMF825 decodes the tone parameters in the format written to YMF825
+func NewVM35FMVoiceFromYMF825(data []byte) (*VM35FMVoice, error) {
+	if len(data) != YMF825ToneSize {
+		return nil, fmt.Errorf("Wrong size of YMF825 tone data (want %d, got %d bytes): %s", YMF825ToneSize, len(data), util.Hex(data))
+	}
+	voice := &VM35FMVoice{Version: VM35FMVoiceVersion_VM5}
+	b := append([]byte{0}, data...) // DrumKey is not included
+	rest := len(b)
+	rdr := bytes.NewReader(b)
+	err := voice.Read(rdr, &rest)
+	if err == nil {
+		err = voice.ReadUnusedRest(rdr, &rest)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "NewVM35FMVoiceFromYMF825 invalid data: %s", util.Hex(data))
+	}
+	return voice, nil
+}
+
 func (v *VM35FMVoice) Read(rdr io.Reader, rest *int) error {
 	switch v.Version {
 	case VM35FMVoiceVersion_VM3Exclusive:
@@ -243,6 +284,8 @@ func (v *VM35FMVoice) Read(rdr io.Reader, rest *int) error {
 	v.LFO = int(global[2] >> 6 & 3)
 	v.PE = global[2]&0x20 != 0
 	v.ALG = enums.Algorithm(global[2] & 7)
+	v.Reserved[0] = global[1] & vm35FMVoiceReservedBits[0]
+	v.Reserved[1] = global[2] & vm35FMVoiceReservedBits[1]
 	v.Operators = [4]*VM35FMOperator{}
 	n := v.ALG.OperatorCount()
 	for op := 0; op < 4; op++ {
@@ -280,6 +323,11 @@ func (v *VM35FMVoice) Bytes(staticLen bool, forYMF825 bool) []byte {
 		byte(pan&31)<<3 | byte(v.BO&3),
 		byte(v.LFO&3)<<6 | util.BoolToByte(pe, 0x20) | byte(v.ALG&7),
 	}
+	if !forYMF825 {
+		for i := range b {
+			b[i] |= v.Reserved[i] & vm35FMVoiceReservedBits[i]
+		}
+	}
 	n := 4
 	if !staticLen {
 		n = v.ALG.OperatorCount()
@@ -290,6 +338,12 @@ func (v *VM35FMVoice) Bytes(staticLen bool, forYMF825 bool) []byte {
 	return b
 }
 
+// Write writes the voice in the layout of the voice libraries (.vm3|.vm5), i.e. DrumKey followed by Bytes(true, false)
+func (v *VM35FMVoice) Write(w io.Writer) error {
+	_, err := w.Write(append([]byte{byte(v.DrumKey)}, v.Bytes(true, false)...))
+	return errors.WithStack(err)
+}
+
 type vm35FMVoiceMarshaler VM35FMVoice
 
 func (v VM35FMVoice) MarshalJSON() ([]byte, error) {
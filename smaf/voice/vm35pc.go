@@ -15,6 +15,7 @@ type VM35Voice interface {
 	fmt.Stringer
 	Read(rdr io.Reader, rest *int) error
 	ReadUnusedRest(rdr io.Reader, rest *int) error
+	Write(w io.Writer) error
 }
 
 type VM35VoicePC struct {
@@ -100,6 +101,47 @@ func (p *VM35VoicePC) Read(rdr io.Reader, rest *int) error {
 	return nil
 }
 
+// Write writes the program in the layout of the voice libraries (.vm3|.vm5) selected by Version
+func (p *VM35VoicePC) Write(w io.Writer) error {
+	name := [16]byte{}
+	copy(name[:], p.Name)
+	var data interface{}
+	switch p.Version {
+	case VM35FMVoiceVersion_VM5:
+		data = &vm5VoicePCHeaderRawData{
+			Enigma1:   uint16(p.Enigma1),
+			Name:      name,
+			Flag:      uint8(p.Flag),
+			BankMSB:   uint8(p.BankMSB),
+			BankLSB:   uint8(p.BankLSB),
+			PC:        uint8(p.PC),
+			DrumNote:  uint8(p.DrumNote),
+			VoiceType: uint8(p.VoiceType),
+		}
+	case VM35FMVoiceVersion_VM3Lib:
+		data = &vm3VoicePCHeaderRawData{
+			Enigma1:   uint16(p.Enigma1),
+			Flag:      uint8(p.Flag),
+			BankMSB:   uint8(p.BankMSB),
+			BankLSB:   uint8(p.BankLSB),
+			PC:        uint8(p.PC),
+			DrumNote:  uint8(p.DrumNote),
+			VoiceType: uint8(p.VoiceType),
+			Name:      name,
+		}
+	default:
+		return fmt.Errorf("Voice libraries cannot contain VM3/VM5 voice of version %d", p.Version)
+	}
+	if p.Voice == nil {
+		return fmt.Errorf("Program %d-%d @%d has no voice", p.BankMSB, p.BankLSB, p.PC)
+	}
+	err := binary.Write(w, binary.BigEndian, data)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return p.Voice.Write(w)
+}
+
 func (p *VM35VoicePC) IsForDrum() bool {
 	return p.DrumNote != 0
 }
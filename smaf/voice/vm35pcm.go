@@ -47,6 +47,11 @@ func (v *VM35PCMVoice) ReadUnusedRest(rdr io.Reader, rest *int) error {
 	return nil
 }
 
+func (v *VM35PCMVoice) Write(w io.Writer) error {
+	_, err := w.Write(v.RawData[:])
+	return errors.WithStack(err)
+}
+
 func (v *VM35PCMVoice) String() string {
 	return util.Hex(v.RawData[:])
 }
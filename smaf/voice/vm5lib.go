@@ -17,7 +17,7 @@ type VM5VoiceLib struct {
 
 func (lib *VM5VoiceLib) Read(rdr io.Reader, rest *int) error {
 	lib.Programs = []*VM35VoicePC{}
-	for pc := 0; pc < 128 && 0 < *rest; pc++ {
+	for pc := 0; pc < maxPrograms && 0 < *rest; pc++ {
 		voice := &VM35VoicePC{Version: VM35FMVoiceVersion_VM5}
 		err := voice.Read(rdr, rest)
 		if err != nil {
@@ -28,6 +28,28 @@ func (lib *VM5VoiceLib) Read(rdr io.Reader, rest *int) error {
 	return nil
 }
 
+// Write writes the programs without the file header
+func (lib *VM5VoiceLib) Write(w io.Writer) error {
+	err := checkProgramCount(len(lib.Programs))
+	if err != nil {
+		return err
+	}
+	for _, p := range lib.Programs {
+		pc := *p
+		pc.Version = VM35FMVoiceVersion_VM5
+		err := pc.Write(w)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Save writes the library to the file with the "VOM5" header
+func (lib *VM5VoiceLib) Save(file string) error {
+	return saveVoiceLib(file, "VOM5", lib)
+}
+
 func (lib *VM5VoiceLib) String() string {
 	s := []string{}
 	for _, v := range lib.Programs {
@@ -137,6 +137,7 @@ type VMAFMVoice struct {
 	LFO       int               `json:"lfo"`
 	FB        int               `json:"fb"`
 	ALG       enums.Algorithm   `json:"alg"`
+	Enigma1   int               `json:"-"` // = 1
 	Operators [4]*VMAFMOperator `json:"operators"`
 }
 
@@ -174,6 +175,7 @@ func (v *VMAFMVoice) Read(rdr io.Reader, rest *int) error {
 	v.LFO = int(global[0] >> 6 & 3)
 	v.FB = int(global[0] >> 3 & 7)
 	v.ALG = enums.Algorithm(global[0] & 7)
+	v.Enigma1 = int(global[1])
 	v.Operators = [4]*VMAFMOperator{}
 	n := v.ALG.OperatorCount()
 	for op := 0; op < 4; op++ {
@@ -203,7 +205,7 @@ func (v *VMAFMVoice) ReadUnusedRest(rdr io.Reader, rest *int) error {
 func (v *VMAFMVoice) Bytes(staticLen bool) []byte {
 	b := []byte{
 		byte(v.LFO&3)<<6 | byte(v.FB&7)<<3 | byte(v.ALG&7),
-		1,
+		byte(v.Enigma1),
 	}
 	n := 4
 	if !staticLen {
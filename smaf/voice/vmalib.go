@@ -18,7 +18,8 @@ type VMAVoiceLib struct {
 
 func (lib *VMAVoiceLib) Read(rdr io.Reader, rest *int) error {
 	lib.Programs = []*VMAVoicePC{}
-	for pc := 0; pc < 128 && 0 < *rest; pc++ {
+	// The names of all programs come first, and then the programs follow
+	for pc := 0; pc < maxPrograms && 0 < *rest; pc++ {
 		voice := &VMAVoicePC{}
 		name := [16]byte{}
 		err := binary.Read(rdr, binary.BigEndian, &name)
@@ -29,17 +30,49 @@ func (lib *VMAVoiceLib) Read(rdr io.Reader, rest *int) error {
 		voice.Name = util.ZeroPadSliceToString(name[:])
 		lib.Programs = append(lib.Programs, voice)
 	}
-	for pc := 0; pc < 128 && 0 < *rest; pc++ {
-		voice := lib.Programs[pc]
-		err := voice.Read(rdr, rest)
+	n := 0
+	for ; n < len(lib.Programs) && 0 < *rest; n++ {
+		err := lib.Programs[n].Read(rdr, rest)
 		if err != nil {
 			return errors.WithStack(err)
 		}
-		lib.Programs = append(lib.Programs, voice)
 	}
+	// Names remain without programs when the library is not full
+	lib.Programs = lib.Programs[:n]
 	return nil
 }
 
+// Write writes the programs without the file header.
+// The names are padded to 128 programs, since the reader does not know how many programs follow
+func (lib *VMAVoiceLib) Write(w io.Writer) error {
+	err := checkProgramCount(len(lib.Programs))
+	if err != nil {
+		return err
+	}
+	for pc := 0; pc < maxPrograms; pc++ {
+		name := [16]byte{}
+		if pc < len(lib.Programs) {
+			copy(name[:], lib.Programs[pc].Name)
+		}
+		_, err := w.Write(name[:])
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	for _, p := range lib.Programs {
+		err := p.Write(w)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Save writes the library to the file with the "FM  " header
+func (lib *VMAVoiceLib) Save(file string) error {
+	return saveVoiceLib(file, "FM  ", lib)
+}
+
 func (lib *VMAVoiceLib) String() string {
 	s := []string{}
 	for _, v := range lib.Programs {
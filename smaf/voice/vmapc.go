@@ -12,10 +12,12 @@ import (
 )
 
 type VMAVoicePC struct {
-	Name  string      `json:"name"`
-	Bank  int         `json:"bank"`
-	PC    int         `json:"pc"`
-	Voice *VMAFMVoice `json:"voice"`
+	Name    string      `json:"name"`
+	Bank    int         `json:"bank"`
+	PC      int         `json:"pc"`
+	Enigma1 int         `json:"-"`
+	Enigma2 int         `json:"-"`
+	Voice   *VMAFMVoice `json:"voice"`
 }
 
 type vmaVoicePCHeaderRawData struct {
@@ -35,6 +37,7 @@ func (p *VMAVoicePC) Read(rdr io.Reader, rest *int) error {
 		return errors.WithStack(err)
 	}
 	*rest -= int(unsafe.Sizeof(data))
+	p.Enigma1 = int(data.Enigma)
 	p.Bank = int(data.Bank)
 	p.PC = int(data.PC)
 	p.Voice = &VMAFMVoice{}
@@ -47,9 +50,29 @@ func (p *VMAVoicePC) Read(rdr io.Reader, rest *int) error {
 		return errors.WithStack(err)
 	}
 	*rest--
+	p.Enigma2 = int(enigma2)
 	return nil
 }
 
+// Write writes the program in the layout of the voice library (.vma). The name is written by VMAVoiceLib
+func (p *VMAVoicePC) Write(w io.Writer) error {
+	if p.Voice == nil {
+		return fmt.Errorf("Program %d @%d has no voice", p.Bank, p.PC)
+	}
+	data := vmaVoicePCHeaderRawData{
+		Enigma: uint8(p.Enigma1),
+		Bank:   uint8(p.Bank),
+		PC:     uint8(p.PC),
+	}
+	err := binary.Write(w, binary.BigEndian, &data)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	b := append(p.Voice.Bytes(true), byte(p.Enigma2))
+	_, err = w.Write(b)
+	return errors.WithStack(err)
+}
+
 func (p *VMAVoicePC) String() string {
 	s := fmt.Sprintf("Bank %d @%d", p.Bank, p.PC)
 	if p.Name != "" {
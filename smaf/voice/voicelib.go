@@ -1,12 +1,62 @@
 package voice
 
-import "fmt"
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// maxPrograms is the number of programs which a voice library can contain
+const maxPrograms = 128
 
 type VoiceLib interface {
 	fmt.Stringer
+	Write(w io.Writer) error
+	Save(file string) error
 }
 
 type chunkHeader struct {
 	Signature uint32
 	Size      uint32
 }
+
+func checkProgramCount(n int) error {
+	if maxPrograms < n {
+		return fmt.Errorf("Too many programs for a voice library (max %d, got %d)", maxPrograms, n)
+	}
+	return nil
+}
+
+// saveVoiceLib writes the programs of lib to the file after the header with the signature
+func saveVoiceLib(file string, signature string, lib VoiceLib) error {
+	var body bytes.Buffer
+	err := lib.Write(&body)
+	if err != nil {
+		return err
+	}
+	hdr := chunkHeader{
+		Signature: binary.BigEndian.Uint32([]byte(signature)),
+		Size:      uint32(body.Len()),
+	}
+	fh, err := os.Create(file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	w := bufio.NewWriter(fh)
+	err = binary.Write(w, binary.BigEndian, &hdr)
+	if err == nil {
+		_, err = body.WriteTo(w)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err2 := fh.Close(); err == nil {
+		err = err2
+	}
+	return errors.WithStack(err)
+}
@@ -0,0 +1,155 @@
+package voice
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const samples = 200
+
+// randomBytes returns n random bytes
+func randomBytes(r *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	r.Read(b)
+	return b
+}
+
+// randomVM35Program returns a random program record of .vm5 or .vm3, whose voice is FM or PCM
+func randomVM35Program(r *rand.Rand, version VM35FMVoiceVersion) []byte {
+	typ := byte(r.Intn(2))
+	voice := randomBytes(r, 1+2+4*7)
+	if typ == 1 {
+		voice = randomBytes(r, 19)
+	}
+	switch version {
+	case VM35FMVoiceVersion_VM5:
+		// Enigma1, Name, Flag, BankMSB, BankLSB, PC, DrumNote, VoiceType
+		hdr := randomBytes(r, 2+16+6)
+		hdr[23] = typ
+		return append(hdr, voice...)
+	default:
+		// Enigma1, Flag, BankMSB, BankLSB, PC, DrumNote, VoiceType, Name
+		hdr := randomBytes(r, 2+6+16)
+		hdr[7] = typ
+		return append(hdr, voice...)
+	}
+}
+
+func TestVM5VoiceLibRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(5))
+	for i := 0; i < samples; i++ {
+		data := []byte{}
+		for pc := r.Intn(maxPrograms) + 1; 0 < pc; pc-- {
+			data = append(data, randomVM35Program(r, VM35FMVoiceVersion_VM5)...)
+		}
+		lib := &VM5VoiceLib{}
+		rest := len(data)
+		if err := lib.Read(bytes.NewReader(data), &rest); err != nil || rest != 0 {
+			t.Fatalf("sample %d: read failed (%v, %d bytes left)", i, err, rest)
+		}
+		var b bytes.Buffer
+		if err := lib.Write(&b); err != nil {
+			t.Fatalf("sample %d: %s", i, err.Error())
+		}
+		compareBytes(t, i, data, b.Bytes())
+	}
+}
+
+func TestVM3VoiceLibRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	for i := 0; i < samples; i++ {
+		data := []byte{}
+		for pc := r.Intn(maxPrograms) + 1; 0 < pc; pc-- {
+			data = append(data, randomVM35Program(r, VM35FMVoiceVersion_VM3Lib)...)
+		}
+		lib := &VM3VoiceLib{}
+		rest := len(data)
+		if err := lib.Read(bytes.NewReader(data), &rest); err != nil || rest != 0 {
+			t.Fatalf("sample %d: read failed (%v, %d bytes left)", i, err, rest)
+		}
+		var b bytes.Buffer
+		if err := lib.Write(&b); err != nil {
+			t.Fatalf("sample %d: %s", i, err.Error())
+		}
+		compareBytes(t, i, data, b.Bytes())
+	}
+}
+
+func TestVMAVoiceLibRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < samples; i++ {
+		// The names of absent programs are zero, as the library is padded to 128 names
+		n := r.Intn(maxPrograms) + 1
+		data := make([]byte, 16*maxPrograms)
+		r.Read(data[:16*n])
+		for pc := 0; pc < n; pc++ {
+			// Enigma, Bank, PC, the voice and Enigma2
+			data = append(data, randomBytes(r, 3+2+4*5+1)...)
+		}
+		lib := &VMAVoiceLib{}
+		rest := len(data)
+		if err := lib.Read(bytes.NewReader(data), &rest); err != nil || rest != 0 {
+			t.Fatalf("sample %d: read failed (%v, %d bytes left)", i, err, rest)
+		}
+		if len(lib.Programs) != n {
+			t.Fatalf("sample %d: %d programs read, want %d", i, len(lib.Programs), n)
+		}
+		var b bytes.Buffer
+		if err := lib.Write(&b); err != nil {
+			t.Fatalf("sample %d: %s", i, err.Error())
+		}
+		compareBytes(t, i, data, b.Bytes())
+	}
+}
+
+// TestSaveVoiceLib checks that the files saved with the headers are read back as they are
+func TestSaveVoiceLib(t *testing.T) {
+	dir, err := ioutil.TempDir("", "voicelib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r := rand.New(rand.NewSource(0))
+	data := []byte{}
+	for pc := 0; pc < 16; pc++ {
+		data = append(data, randomVM35Program(r, VM35FMVoiceVersion_VM5)...)
+	}
+	lib := &VM5VoiceLib{}
+	rest := len(data)
+	if err := lib.Read(bytes.NewReader(data), &rest); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "test.vm5")
+	if err := lib.Save(file); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareBytes(t, 0, data, saved[8:])
+	loaded, err := NewVM5VoiceLib(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := loaded.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	compareBytes(t, 0, data, b.Bytes())
+}
+
+func compareBytes(t *testing.T, sample int, want, got []byte) {
+	if len(want) != len(got) {
+		t.Fatalf("sample %d: %d bytes written, want %d", sample, len(got), len(want))
+	}
+	for i := range want {
+		if want[i] != got[i] {
+			t.Fatalf("sample %d: 0x%02X at 0x%X, want 0x%02X", sample, got[i], i, want[i])
+		}
+	}
+}
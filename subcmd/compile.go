@@ -0,0 +1,125 @@
+package subcmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/but80/smaf825/sequencer"
+	"github.com/but80/smaf825/smaf/chunk"
+	"github.com/but80/smaf825/smaf/log"
+	"github.com/urfave/cli"
+)
+
+var Compile = cli.Command{
+	Name:      "compile",
+	Aliases:   []string{"c"},
+	Usage:     "Compiles a SMAF format file into a device command stream (.y825)",
+	ArgsUsage: "<filename>",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: `Output filename (default: input filename with .y825 extension)`,
+		},
+		cli.IntFlag{
+			Name:  "volume, v",
+			Usage: `Master volume (0..63)`,
+			Value: 48,
+		},
+		cli.IntFlag{
+			Name:  "gain, g",
+			Usage: `Analog gain (0..3)`,
+			Value: 1,
+		},
+		cli.IntFlag{
+			Name:  "seqvol, V",
+			Usage: `SeqVol (0..31)`,
+			Value: 16,
+		},
+		cli.IntFlag{
+			Name:  "loop, l",
+			Usage: `Loop count (1..)`,
+			Value: 1,
+		},
+		cli.StringFlag{
+			Name:  "from, f",
+			Usage: `Start position (msec, mm:ss or #event_index)`,
+		},
+		cli.StringFlag{
+			Name:  "to, T",
+			Usage: `End position (msec, mm:ss or #event_index)`,
+		},
+		cli.Float64Flag{
+			Name:  "speed, x",
+			Usage: `Tempo multiplier (0.25..4)`,
+			Value: 1,
+		},
+		cli.IntFlag{
+			Name:  "transpose, k",
+			Usage: `Transposition in semitones (-24..24)`,
+		},
+		cli.StringFlag{
+			Name:  "mute, m",
+			Usage: `Comma separated channels to mute (1..16)`,
+		},
+		cli.StringFlag{
+			Name:  "solo",
+			Usage: `Comma separated channels to solo (1..16)`,
+		},
+		cli.StringFlag{
+			Name:  "map, M",
+			Usage: `Comma separated pairs of channel (1..16) and voice (0..15) to assign, e.g. 9:0`,
+		},
+		cli.BoolFlag{
+			Name:  "debug, d",
+			Usage: `Show debug messages`,
+		},
+		cli.BoolFlag{
+			Name:  "quiet, q",
+			Usage: `Suppress information messages`,
+		},
+		cli.BoolFlag{
+			Name:  "silent, Q",
+			Usage: `Do not output any messages`,
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		if ctx.NArg() < 1 || !isValidSequencerOptions(ctx) || ctx.Int("loop") < 1 {
+			cli.ShowCommandHelp(ctx, "compile")
+			os.Exit(1)
+		}
+		setLogLevel(ctx)
+		opts, err := newSequencerOptions(ctx)
+		if err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		args := ctx.Args()
+		file := args[0]
+		output := ctx.String("output")
+		// Flags after the filename are not parsed by cli, so "-o" is also accepted there
+		if len(args) == 3 && (args[1] == "-o" || args[1] == "--output") {
+			output = args[2]
+		} else if 1 < len(args) {
+			cli.ShowCommandHelp(ctx, "compile")
+			os.Exit(1)
+		}
+		if output == "" {
+			output = strings.TrimSuffix(file, filepath.Ext(file)) + ".y825"
+		}
+		mmf, err := chunk.NewFileChunk(file)
+		if err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		q := sequencer.Sequencer{}
+		stream, err := q.Compile(mmf, opts)
+		if err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		err = stream.Save(output)
+		if err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		log.Infof("%d commands written to %s", len(stream.Commands), output)
+		return nil
+	},
+}
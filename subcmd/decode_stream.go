@@ -0,0 +1,62 @@
+package subcmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/but80/smaf825/serial"
+	"github.com/but80/smaf825/smaf/log"
+	"github.com/urfave/cli"
+)
+
+var DecodeStream = cli.Command{
+	Name:      "decode-stream",
+	Aliases:   []string{"ds"},
+	Usage:     "Prints a timeline of a device command stream (.y825) or bytes captured by file: device",
+	ArgsUsage: "<filename>",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "debug, d",
+			Usage: `Show debug messages`,
+		},
+		cli.BoolFlag{
+			Name:  "quiet, q",
+			Usage: `Suppress information messages`,
+		},
+		cli.BoolFlag{
+			Name:  "silent, Q",
+			Usage: `Do not output any messages`,
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		if ctx.NArg() < 1 {
+			cli.ShowCommandHelp(ctx, "decode-stream")
+			os.Exit(1)
+		}
+		setLogLevel(ctx)
+		data, err := ioutil.ReadFile(ctx.Args()[0])
+		if err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		var commands []serial.Command
+		if bytes.HasPrefix(data, []byte(serial.StreamMagic)) {
+			stream := &serial.Stream{}
+			err = stream.Read(bytes.NewReader(data))
+			if err != nil {
+				return cli.NewExitError(err, 1)
+			}
+			h := stream.Header
+			fmt.Printf("version %d  volume %d  gain %d  seqvol %d\n", h.SketchVersion, h.Volume, h.Gain, h.SeqVol)
+			commands = stream.Commands
+		} else {
+			commands, err = serial.ReadCommands(bytes.NewReader(data))
+			if err != nil {
+				log.Warnf(err.Error())
+			}
+		}
+		fmt.Println(serial.DecodeCommands(commands))
+		return nil
+	},
+}
@@ -31,6 +31,10 @@ var Dump = cli.Command{
 			Name:  "exclusive, x",
 			Usage: `Dumps exclusives only`,
 		},
+		cli.BoolFlag{
+			Name:  "timeline, t",
+			Usage: `Dumps events with absolute time`,
+		},
 		cli.BoolFlag{
 			Name:  "debug, d",
 			Usage: `Show debug messages`,
@@ -74,6 +78,11 @@ var Dump = cli.Command{
 				if ctx.Bool("voice") {
 					data = exclusives.Voices()
 				}
+			} else if err == nil && ctx.Bool("timeline") {
+				data, err = chunk.NewTimeline(fc)
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
 			}
 		case ".vma":
 			data, err = voice.NewVMAVoiceLib(file)
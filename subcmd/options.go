@@ -0,0 +1,124 @@
+package subcmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/but80/smaf825/sequencer"
+	"github.com/but80/smaf825/serial"
+	"github.com/but80/smaf825/smaf/enums"
+	"github.com/but80/smaf825/smaf/log"
+	"github.com/urfave/cli"
+)
+
+func setLogLevel(ctx *cli.Context) {
+	if ctx.Bool("debug") {
+		log.Level = log.LogLevel_Debug
+	} else if ctx.Bool("silent") {
+		log.Level = log.LogLevel_None
+	} else if ctx.Bool("quiet") {
+		log.Level = log.LogLevel_Warn
+	}
+}
+
+func isValidSequencerOptions(ctx *cli.Context) bool {
+	return 0 <= ctx.Int("loop") &&
+		0 <= ctx.Int("volume") && ctx.Int("volume") <= 63 &&
+		0 <= ctx.Int("gain") && ctx.Int("gain") <= 3 &&
+		0 <= ctx.Int("seqvol") && ctx.Int("seqvol") <= 31 &&
+		220 <= ctx.GlobalFloat64("tune") && ctx.GlobalFloat64("tune") <= 880 &&
+		.25 <= ctx.Float64("speed") && ctx.Float64("speed") <= 4 &&
+		-24 <= ctx.Int("transpose") && ctx.Int("transpose") <= 24
+}
+
+// newSequencerOptions creates options from the flags common to play and compile
+func newSequencerOptions(ctx *cli.Context) (*sequencer.SequencerOptions, error) {
+	var from, to *sequencer.Position
+	if ctx.String("from") != "" {
+		p, err := sequencer.ParsePosition(ctx.String("from"))
+		if err != nil {
+			return nil, err
+		}
+		from = p
+	}
+	if ctx.String("to") != "" {
+		p, err := sequencer.ParsePosition(ctx.String("to"))
+		if err != nil {
+			return nil, err
+		}
+		to = p
+	}
+	mute, err := parseChannels(ctx.String("mute"))
+	if err != nil {
+		return nil, err
+	}
+	solo, err := parseChannels(ctx.String("solo"))
+	if err != nil {
+		return nil, err
+	}
+	// play drives 16 voices for each of the devices given by --device
+	voices := serial.VoicesPerPort
+	if n := len(ctx.StringSlice("device")); 1 < n {
+		voices *= n
+	}
+	chmap, err := parseChannelMap(ctx.String("map"), voices)
+	if err != nil {
+		return nil, err
+	}
+	return &sequencer.SequencerOptions{
+		Loop:       ctx.Int("loop"),
+		Volume:     ctx.Int("volume"),
+		Gain:       ctx.Int("gain"),
+		SeqVol:     ctx.Int("seqvol"),
+		BaudRate:   ctx.Int("baudrate"),
+		Tune:       ctx.GlobalFloat64("tune"),
+		Speed:      ctx.Float64("speed"),
+		Transpose:  ctx.Int("transpose"),
+		From:       from,
+		To:         to,
+		Mute:       mute,
+		Solo:       solo,
+		ChannelMap: chmap,
+	}, nil
+}
+
+// parseChannels parses comma separated channel numbers (1..16) like "3,4"
+func parseChannels(s string) ([]enums.Channel, error) {
+	result := []enums.Channel{}
+	if s == "" {
+		return result, nil
+	}
+	for _, t := range strings.Split(s, ",") {
+		ch, err := strconv.Atoi(strings.TrimSpace(t))
+		if err != nil || ch < 1 || 16 < ch {
+			return nil, fmt.Errorf("Invalid channel number: %s", t)
+		}
+		result = append(result, enums.Channel(ch-1))
+	}
+	return result, nil
+}
+
+// parseChannelMap parses comma separated pairs of channel (1..16) and voice (0..voices-1) like "9:0,10:1"
+func parseChannelMap(s string, voices int) (map[enums.Channel]int, error) {
+	result := map[enums.Channel]int{}
+	if s == "" {
+		return result, nil
+	}
+	for _, t := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(t), ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid channel mapping: %s", t)
+		}
+		ch, err := strconv.Atoi(kv[0])
+		if err != nil || ch < 1 || 16 < ch {
+			return nil, fmt.Errorf("Invalid channel number: %s", t)
+		}
+		v, err := strconv.Atoi(kv[1])
+		if err != nil || v < 0 || voices <= v {
+			return nil, fmt.Errorf("Invalid voice number: %s", t)
+		}
+		result[enums.Channel(ch-1)] = v
+	}
+	return result, nil
+}
@@ -2,6 +2,8 @@ package subcmd
 
 import (
 	"os"
+	"sync/atomic"
+	"time"
 
 	"github.com/but80/smaf825/sequencer"
 	"github.com/but80/smaf825/serial"
@@ -13,13 +15,17 @@ import (
 var Play = cli.Command{
 	Name:      "play",
 	Aliases:   []string{"p"},
-	Usage:     "Plays SMAF format files (.mmf|.spf)",
-	ArgsUsage: "<device> <filename>",
+	Usage:     "Plays SMAF format files (.mmf|.spf), directories or playlists (.m3u)",
+	ArgsUsage: "[<device>] <filename|directory|playlist>...",
 	Flags: []cli.Flag{
 		cli.BoolFlag{
 			Name:  "state, s",
 			Usage: `Show state`,
 		},
+		cli.BoolFlag{
+			Name:  "interactive, i",
+			Usage: `Control playback by keyboard`,
+		},
 		cli.IntFlag{
 			Name:  "volume, v",
 			Usage: `Master volume (0..63)`,
@@ -40,11 +46,65 @@ var Play = cli.Command{
 			Usage: `Loop count (0: infinite)`,
 			Value: 1,
 		},
+		cli.StringFlag{
+			Name:  "from, f",
+			Usage: `Start position (msec, mm:ss or #event_index)`,
+		},
+		cli.StringFlag{
+			Name:  "to, T",
+			Usage: `End position (msec, mm:ss or #event_index)`,
+		},
+		cli.Float64Flag{
+			Name:  "speed, x",
+			Usage: `Tempo multiplier (0.25..4)`,
+			Value: 1,
+		},
+		cli.IntFlag{
+			Name:  "transpose, k",
+			Usage: `Transposition in semitones (-24..24)`,
+		},
+		cli.StringFlag{
+			Name:  "mute, m",
+			Usage: `Comma separated channels to mute (1..16)`,
+		},
+		cli.StringFlag{
+			Name:  "solo, o",
+			Usage: `Comma separated channels to solo (1..16)`,
+		},
+		cli.StringFlag{
+			Name:  "map, M",
+			Usage: `Comma separated pairs of channel (1..16) and voice (0..15, or up to 16 * devices - 1 with --device) to assign, e.g. 9:0`,
+		},
+		cli.BoolFlag{
+			Name:  "shuffle, z",
+			Usage: `Shuffle playlist`,
+		},
+		cli.BoolFlag{
+			Name:  "repeat, R",
+			Usage: `Repeat playlist infinitely`,
+		},
+		cli.IntFlag{
+			Name:  "gap, G",
+			Usage: `Gap between songs in msec`,
+			Value: 1000,
+		},
 		cli.IntFlag{
 			Name:  "baudrate, r",
 			Usage: `Baud rate ` + serial.BaudRateList(),
 			Value: 57600,
 		},
+		cli.StringSliceFlag{
+			Name:  "device, D",
+			Usage: `Device to drive together, instead of <device>. Repeat to use several boards as one`,
+		},
+		cli.BoolFlag{
+			Name:  "pan, P",
+			Usage: `Play notes by the first (left) or the last (right) device by panpot of their channels`,
+		},
+		cli.StringFlag{
+			Name:  "reconnect, c",
+			Usage: `Action when the device is disconnected (none|pause|continue)`,
+		},
 		cli.BoolFlag{
 			Name:  "debug, d",
 			Usage: `Show debug messages`,
@@ -59,41 +119,98 @@ var Play = cli.Command{
 		},
 	},
 	Action: func(ctx *cli.Context) error {
-		if ctx.NArg() < 2 || ctx.Int("loop") < 0 ||
-			ctx.Int("volume") < 0 || 63 < ctx.Int("volume") ||
-			ctx.Int("gain") < 0 || 3 < ctx.Int("gain") ||
-			ctx.Int("seqvol") < 0 || 31 < ctx.Int("seqvol") ||
+		devices := ctx.StringSlice("device")
+		nDeviceArgs := 1
+		if 0 < len(devices) {
+			nDeviceArgs = 0
+		}
+		if ctx.NArg() < nDeviceArgs+1 || !isValidSequencerOptions(ctx) ||
+			ctx.Int("gap") < 0 ||
 			!serial.IsValidBaudRate(ctx.Int("baudrate")) {
 			cli.ShowCommandHelp(ctx, "play")
 			os.Exit(1)
 		}
-		if ctx.Bool("debug") {
-			log.Level = log.LogLevel_Debug
-		} else if ctx.Bool("silent") {
-			log.Level = log.LogLevel_None
-		} else if ctx.Bool("quiet") {
-			log.Level = log.LogLevel_Warn
+		setLogLevel(ctx)
+		opts, err := newSequencerOptions(ctx)
+		if err != nil {
+			return cli.NewExitError(err, 1)
 		}
 		args := ctx.Args()
-		mmf, err := chunk.NewFileChunk(args[1])
+		files, err := collectFiles(args[nDeviceArgs:])
+		if err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		if len(files) == 0 {
+			return cli.NewExitError("No files to play", 1)
+		}
+		reconnect, err := sequencer.ParseReconnectMode(ctx.String("reconnect"))
 		if err != nil {
 			return cli.NewExitError(err, 1)
 		}
 		q := sequencer.Sequencer{
-			DeviceName: args[0],
-			ShowState:  ctx.Bool("state"),
+			Devices:   devices,
+			Pan:       ctx.Bool("pan"),
+			Reconnect: reconnect,
+			ShowState: ctx.Bool("state"),
 		}
-		opts := &sequencer.SequencerOptions{
-			Loop:     ctx.Int("loop"),
-			Volume:   ctx.Int("volume"),
-			Gain:     ctx.Int("gain"),
-			SeqVol:   ctx.Int("seqvol"),
-			BaudRate: ctx.Int("baudrate"),
+		if nDeviceArgs == 1 {
+			q.DeviceName = args[0]
 		}
-		err = q.Play(mmf, opts)
+		err = q.Open(opts.BaudRate)
 		if err != nil {
 			return cli.NewExitError(err, 1)
 		}
+		defer q.Close()
+		// quit is set by the transport goroutine
+		var quit int32
+		if ctx.Bool("interactive") {
+			stop, err := startTransport(&q, func() { atomic.StoreInt32(&quit, 1) })
+			if err != nil {
+				log.Warnf("Keyboard control is unavailable: %s", err.Error())
+			} else {
+				defer stop()
+			}
+		}
+		played := false
+		for {
+			list := files
+			if ctx.Bool("shuffle") {
+				list = shuffleFiles(files)
+			}
+			playedInRound := false
+			for i, file := range list {
+				if atomic.LoadInt32(&quit) != 0 {
+					return nil
+				}
+				if 1 < len(list) {
+					log.Infof("[%d/%d] %s", i+1, len(list), file)
+				}
+				mmf, err := chunk.NewFileChunk(file)
+				if err != nil {
+					log.Warnf("Skipping %s: %s", file, err.Error())
+					continue
+				}
+				if played && 0 < ctx.Int("gap") {
+					time.Sleep(time.Duration(ctx.Int("gap")) * time.Millisecond)
+				}
+				err = q.Play(mmf, opts)
+				if err := q.PortError(); err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				if err != nil && err != sequencer.ErrStopped {
+					log.Warnf("Skipping %s: %s", file, err.Error())
+					continue
+				}
+				played = true
+				playedInRound = true
+			}
+			if !ctx.Bool("repeat") || !playedInRound {
+				break
+			}
+		}
+		if !played {
+			return cli.NewExitError("No playable files", 1)
+		}
 		return nil
 	},
 }
@@ -0,0 +1,106 @@
+package subcmd
+
+import (
+	"bufio"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/but80/smaf825/smaf/log"
+	"github.com/pkg/errors"
+)
+
+func isPlayableFile(file string) bool {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".mmf", ".spf":
+		return true
+	}
+	return false
+}
+
+// collectFiles expands directories and .m3u lists into the SMAF files to play
+func collectFiles(args []string) ([]string, error) {
+	result := []string{}
+	for _, arg := range args {
+		files, err := expandPlaylistItem(arg, 0)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, files...)
+	}
+	return result, nil
+}
+
+func expandPlaylistItem(item string, depth int) ([]string, error) {
+	if 8 < depth {
+		return nil, errors.Errorf("Too deep nesting of playlists: %s", item)
+	}
+	stat, err := os.Stat(item)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if stat.IsDir() {
+		files := []string{}
+		err := filepath.Walk(item, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				log.Warnf("%s", err.Error())
+				return nil
+			}
+			if !info.IsDir() && isPlayableFile(path) {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		sort.Strings(files)
+		return files, nil
+	}
+	if strings.ToLower(filepath.Ext(item)) == ".m3u" {
+		return readM3U(item, depth)
+	}
+	return []string{item}, nil
+}
+
+func readM3U(file string, depth int) ([]string, error) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer fh.Close()
+	dir := filepath.Dir(file)
+	files := []string{}
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(dir, line)
+		}
+		items, err := expandPlaylistItem(line, depth+1)
+		if err != nil {
+			log.Warnf("Skipping %s: %s", line, err.Error())
+			continue
+		}
+		files = append(files, items...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return files, nil
+}
+
+func shuffleFiles(files []string) []string {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	result := make([]string, len(files))
+	for i, j := range rnd.Perm(len(files)) {
+		result[i] = files[j]
+	}
+	return result
+}
@@ -0,0 +1,66 @@
+package subcmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/but80/smaf825/serial"
+	"github.com/urfave/cli"
+)
+
+var Ports = cli.Command{
+	Name:    "ports",
+	Aliases: []string{"P"},
+	Usage:   "Lists the serial ports and the versions of the bridge sketches running on them",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "all, a",
+			Usage: `Also list the ports which cannot be opened`,
+		},
+		cli.IntFlag{
+			Name:  "baudrate, r",
+			Usage: `Baud rate ` + serial.BaudRateList(),
+			Value: 57600,
+		},
+		cli.BoolFlag{
+			Name:  "debug, d",
+			Usage: `Show debug messages`,
+		},
+		cli.BoolFlag{
+			Name:  "quiet, q",
+			Usage: `Suppress information messages`,
+		},
+		cli.BoolFlag{
+			Name:  "silent, Q",
+			Usage: `Do not output any messages`,
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		if !serial.IsValidBaudRate(ctx.Int("baudrate")) {
+			cli.ShowCommandHelp(ctx, "ports")
+			os.Exit(1)
+		}
+		setLogLevel(ctx)
+		names := serial.CandidatePorts()
+		if len(names) == 0 {
+			return cli.NewExitError("No serial ports found", 1)
+		}
+		found := 0
+		for _, r := range serial.ProbePorts(names, ctx.Int("baudrate")) {
+			switch {
+			case r.Port != nil:
+				found++
+				fmt.Printf("%s\tbridge version %d (protocol v%d)\n", r.Name, r.Version, r.Port.Protocol())
+				r.Port.Close()
+			case 0 < r.Version:
+				fmt.Printf("%s\tincompatible bridge version %d\n", r.Name, r.Version)
+			case r.Available || ctx.Bool("all"):
+				fmt.Printf("%s\tno bridge: %s\n", r.Name, r.Err.Error())
+			}
+		}
+		if found == 0 {
+			return cli.NewExitError("No bridge found", 1)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,157 @@
+package subcmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/but80/smaf825/sequencer"
+	"github.com/but80/smaf825/serial"
+	"github.com/but80/smaf825/ymf825"
+	"github.com/urfave/cli"
+)
+
+type registerCheck struct {
+	reg  *ymf825.Register
+	want uint8
+}
+
+// initialRegisters are the registers set by init_825 of bridge.ino
+var initialRegisters = []registerCheck{
+	{ymf825.ClockEnable, ymf825.ClockEnable.Pack(1)},
+	{ymf825.Reset, ymf825.Reset.Pack(0)},
+	{ymf825.AnalogPowerDown, ymf825.AnalogPowerDown.Pack(0)},
+	{ymf825.AnalogGain, ymf825.AnalogGain.Pack(1)},
+	{ymf825.SequencerVolume, ymf825.SequencerVolume.Pack(16, 0, 0)},
+	{ymf825.MasterVolume, ymf825.MasterVolume.Pack(56)},
+}
+
+var Selftest = cli.Command{
+	Name:      "selftest",
+	Aliases:   []string{"st"},
+	Usage:     "Checks the connection to YMF825 board by reading back its registers",
+	ArgsUsage: "<device>",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "no-scale, n",
+			Usage: `Do not play the test scale`,
+		},
+		cli.IntFlag{
+			Name:  "baudrate, r",
+			Usage: `Baud rate ` + serial.BaudRateList(),
+			Value: 57600,
+		},
+		cli.BoolFlag{
+			Name:  "debug, d",
+			Usage: `Show debug messages`,
+		},
+		cli.BoolFlag{
+			Name:  "quiet, q",
+			Usage: `Suppress information messages`,
+		},
+		cli.BoolFlag{
+			Name:  "silent, Q",
+			Usage: `Do not output any messages`,
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		if ctx.NArg() < 1 || !serial.IsValidBaudRate(ctx.Int("baudrate")) ||
+			ctx.GlobalFloat64("tune") < 220 || 880 < ctx.GlobalFloat64("tune") {
+			cli.ShowCommandHelp(ctx, "selftest")
+			os.Exit(1)
+		}
+		setLogLevel(ctx)
+		port, err := serial.NewSerialPort(ctx.Args()[0], ctx.Int("baudrate"))
+		if err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		defer port.Close()
+		port.Start(context.Background())
+		err = selftest(port, !ctx.Bool("no-scale"), ctx.GlobalFloat64("tune"))
+		if err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		return nil
+	},
+}
+
+func selftest(port *serial.SerialPort, scale bool, tune float64) error {
+	// Errors of ReadRegister mean that the sketch does not reply, and mismatches mean a fault between Arduino and YMF825
+	failed, checked := 0, 0
+	values := map[uint8]int{}
+	check := func(label string, got, want uint8) {
+		checked++
+		values[got]++
+		result := "OK"
+		if got != want {
+			failed++
+			result = fmt.Sprintf("NG (want 0x%02X)", want)
+		}
+		fmt.Printf("  %-32s 0x%02X  %s\n", label, got, result)
+	}
+
+	fmt.Println("registers after initialization:")
+	for _, r := range initialRegisters {
+		v, err := port.ReadRegister(r.reg.Addr)
+		if err != nil {
+			return err
+		}
+		check(fmt.Sprintf("#%-2d %s", r.reg.Addr, r.reg.Name), v, r.want)
+	}
+
+	fmt.Println("write and read back:")
+	reg := ymf825.FnumLow
+	for _, pattern := range []int{0x55, 0x2A, 0x7F, 0x00} {
+		// Different values for each voice also check the voice selection by #11
+		for ch := 0; ch < 16; ch++ {
+			port.SendChannelRegister(ch, reg.Addr, reg.Pack(pattern+ch))
+		}
+		for ch := 0; ch < 16; ch++ {
+			v, err := port.ReadChannelRegister(ch, reg.Addr)
+			if err != nil {
+				return err
+			}
+			check(fmt.Sprintf("Ch.%02d #%d pattern 0x%02X", ch, reg.Addr, pattern), reg.Pack(reg.Unpack(v)...), reg.Pack(pattern+ch))
+		}
+	}
+	if len(values) == 1 && 0 < failed {
+		for v := range values {
+			fmt.Printf("all registers read as 0x%02X. MISO, SS or the power of YMF825Board may be disconnected\n", v)
+		}
+	}
+
+	fmt.Println("round-trip latency:")
+	var min, max, total time.Duration
+	const n = 10
+	for i := 0; i < n; i++ {
+		t := time.Now()
+		_, err := port.ReadRegister(ymf825.ClockEnable.Addr)
+		if err != nil {
+			return err
+		}
+		d := time.Since(t)
+		if i == 0 || d < min {
+			min = d
+		}
+		if max < d {
+			max = d
+		}
+		total += d
+	}
+	fmt.Printf("  min %v  avg %v  max %v\n", min, total/n, max)
+
+	if scale {
+		fmt.Println("playing test scale")
+		sequencer.TestScale(port, tune)
+		for !port.Flush() {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	if 0 < failed {
+		return fmt.Errorf("%d of %d checks failed. Please check the wiring between Arduino and YMF825Board", failed, checked)
+	}
+	fmt.Printf("all %d checks passed\n", checked)
+	return nil
+}
@@ -0,0 +1,123 @@
+package subcmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/but80/smaf825/serial"
+	"github.com/but80/smaf825/smaf/log"
+	"github.com/urfave/cli"
+	"github.com/xlab/closer"
+)
+
+var Stream = cli.Command{
+	Name:      "stream",
+	Aliases:   []string{"s"},
+	Usage:     "Sends a device command stream (.y825) made by compile",
+	ArgsUsage: "<device> <filename>",
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:  "volume, v",
+			Usage: `Master volume (0..63, default: the value in the file)`,
+			Value: -1,
+		},
+		cli.IntFlag{
+			Name:  "gain, g",
+			Usage: `Analog gain (0..3, default: the value in the file)`,
+			Value: -1,
+		},
+		cli.IntFlag{
+			Name:  "seqvol, V",
+			Usage: `SeqVol (0..31, default: the value in the file)`,
+			Value: -1,
+		},
+		cli.IntFlag{
+			Name:  "baudrate, r",
+			Usage: `Baud rate ` + serial.BaudRateList(),
+			Value: 57600,
+		},
+		cli.BoolFlag{
+			Name:  "debug, d",
+			Usage: `Show debug messages`,
+		},
+		cli.BoolFlag{
+			Name:  "quiet, q",
+			Usage: `Suppress information messages`,
+		},
+		cli.BoolFlag{
+			Name:  "silent, Q",
+			Usage: `Do not output any messages`,
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		if ctx.NArg() < 2 ||
+			63 < ctx.Int("volume") || 3 < ctx.Int("gain") || 31 < ctx.Int("seqvol") ||
+			ctx.GlobalFloat64("tune") < 220 || 880 < ctx.GlobalFloat64("tune") ||
+			!serial.IsValidBaudRate(ctx.Int("baudrate")) {
+			cli.ShowCommandHelp(ctx, "stream")
+			os.Exit(1)
+		}
+		setLogLevel(ctx)
+		args := ctx.Args()
+		stream, err := serial.LoadStream(args[1])
+		if err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		if !stream.IsCompatible() {
+			return cli.NewExitError(fmt.Errorf(
+				"Stream version mismatch (want %d <= version < %d, got %d). Please compile the song again.",
+				serial.SKETCH_VERSION_GTE, serial.SKETCH_VERSION_LT, stream.Header.SketchVersion,
+			), 1)
+		}
+		if tune := ctx.GlobalFloat64("tune"); tune != 440 {
+			n := stream.Retune(tune / 440.0)
+			log.Debugf("retuned %d fine tune writes", n)
+		}
+		volume, gain, seqvol := int(stream.Header.Volume), int(stream.Header.Gain), int(stream.Header.SeqVol)
+		if 0 <= ctx.Int("volume") {
+			volume = ctx.Int("volume")
+		}
+		if 0 <= ctx.Int("gain") {
+			gain = ctx.Int("gain")
+		}
+		if 0 <= ctx.Int("seqvol") {
+			seqvol = ctx.Int("seqvol")
+		}
+		port, err := serial.NewSerialPort(args[0], ctx.Int("baudrate"))
+		if err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		defer port.Close()
+		if v := port.SketchVersion(); v < int(stream.Header.SketchVersion) {
+			return cli.NewExitError(fmt.Errorf(
+				"Sketch version %d is too old for the stream (want %d or later). Please rewrite \"bridge/bridge.ino\" onto Arduino.",
+				v, stream.Header.SketchVersion,
+			), 1)
+		}
+		port.Start(context.Background())
+		closer.Bind(func() {
+			// Silences voices immediately without waiting for the queued stream
+			port.Pause()
+			for i := 0; i < 100 && !port.Flush(); i++ {
+				time.Sleep(time.Millisecond)
+			}
+			port.Close()
+		})
+		port.SendMasterVolume(volume)
+		port.SendAnalogGain(gain)
+		port.SendSeqVol(seqvol)
+		port.SendCommands(stream.Commands)
+		log.Infof("streaming %d commands", len(stream.Commands))
+		for !port.Flush() {
+			time.Sleep(time.Millisecond)
+		}
+		select {
+		case err := <-port.Err():
+			return cli.NewExitError(err, 1)
+		default:
+		}
+		return nil
+	},
+}
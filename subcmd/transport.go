@@ -0,0 +1,101 @@
+package subcmd
+
+import (
+	"github.com/but80/smaf825/sequencer"
+	"github.com/but80/smaf825/smaf/enums"
+	"github.com/but80/smaf825/smaf/log"
+	"github.com/but80/smaf825/terminal"
+	"github.com/xlab/closer"
+)
+
+const transportHelp = "[Space] pause/resume  [<-/->] seek -/+5s  [+/-] volume  [1-9,0] mute Ch.1-10  [s][1-9,0] solo  [n] next  [q] quit"
+
+// startTransport controls the sequencer by key strokes until the returned function is called
+func startTransport(q *sequencer.Sequencer, quit func()) (func(), error) {
+	restore, err := terminal.MakeRaw()
+	if err != nil {
+		return nil, err
+	}
+	input, cancel, err := terminal.NewInput()
+	if err != nil {
+		restore()
+		return nil, err
+	}
+	closer.Bind(restore)
+	log.Infof(transportHelp)
+	keys := terminal.ReadKeys(input)
+	done := make(chan bool)
+	go func() {
+		solo := false
+		for {
+			var key terminal.Key
+			select {
+			case <-done:
+				return
+			case k, ok := <-keys:
+				if !ok {
+					return
+				}
+				key = k
+			}
+			switch {
+			case key == ' ':
+				if q.IsPaused() {
+					log.Infof("resumed")
+					q.Resume()
+				} else {
+					log.Infof("paused")
+					q.Pause()
+				}
+			case key == terminal.Key_Left || key == terminal.Key_Right:
+				msec := q.CurrentMsec() - 5000
+				if key == terminal.Key_Right {
+					msec += 10000
+				}
+				if msec < 0 {
+					msec = 0
+				}
+				q.Seek(sequencer.Position{Msec: msec, Event: -1})
+			case key == '+' || key == '=' || key == terminal.Key_Up:
+				q.SetMasterVolume(q.MasterVolume() + 1)
+				log.Infof("volume %d", q.MasterVolume())
+			case key == '-' || key == '_' || key == terminal.Key_Down:
+				q.SetMasterVolume(q.MasterVolume() - 1)
+				log.Infof("volume %d", q.MasterVolume())
+			case key == 's' || key == 'S':
+				solo = true
+				continue
+			case '0' <= key && key <= '9':
+				ch := enums.Channel(key - '1')
+				if key == '0' {
+					ch = 9
+				}
+				if solo {
+					q.ToggleSolo(ch)
+				} else {
+					q.ToggleMute(ch)
+				}
+				if q.IsAudible(ch) {
+					log.Infof("Ch.%d on", ch+1)
+				} else {
+					log.Infof("Ch.%d off", ch+1)
+				}
+			case key == 'n' || key == 'N':
+				q.Stop()
+			case key == 'q' || key == 'Q':
+				log.Infof("quitting")
+				quit()
+				q.Stop()
+			}
+			solo = false
+		}
+	}()
+	return func() {
+		close(done)
+		cancel()
+		// The reader may be sending a key nobody receives anymore
+		for range keys {
+		}
+		restore()
+	}, nil
+}
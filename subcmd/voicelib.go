@@ -0,0 +1,166 @@
+package subcmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/but80/smaf825/smaf/chunk"
+	"github.com/but80/smaf825/smaf/log"
+	"github.com/but80/smaf825/smaf/voice"
+	"github.com/urfave/cli"
+)
+
+var VoiceLib = cli.Command{
+	Name:      "voicelib",
+	Aliases:   []string{"vl"},
+	Usage:     "Builds a voice library (.vm5|.vm3|.vma) from the voices in SMAF format files or other voice libraries",
+	ArgsUsage: "<output> <filename>...",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "debug, d",
+			Usage: `Show debug messages`,
+		},
+		cli.BoolFlag{
+			Name:  "quiet, q",
+			Usage: `Suppress information messages`,
+		},
+		cli.BoolFlag{
+			Name:  "silent, Q",
+			Usage: `Do not output any messages`,
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		if ctx.NArg() < 2 {
+			cli.ShowCommandHelp(ctx, "voicelib")
+			os.Exit(1)
+		}
+		setLogLevel(ctx)
+		args := ctx.Args()
+		output := args[0]
+		vm35 := []*voice.VM35VoicePC{}
+		vma := []*voice.VMAVoicePC{}
+		for _, file := range args[1:] {
+			a, b, err := collectVoices(file)
+			if err != nil {
+				return cli.NewExitError(err, 1)
+			}
+			vm35 = append(vm35, a...)
+			vma = append(vma, b...)
+		}
+		var lib voice.VoiceLib
+		n := 0
+		seen := map[string]bool{}
+		switch ext := strings.ToLower(filepath.Ext(output)); ext {
+		case ".vm5", ".vm3":
+			version := voice.VM35FMVoiceVersion_VM5
+			if ext == ".vm3" {
+				version = voice.VM35FMVoiceVersion_VM3Lib
+			}
+			for _, p := range vma {
+				vm35 = append(vm35, p.ToVM35())
+			}
+			programs := []*voice.VM35VoicePC{}
+			for _, p := range vm35 {
+				pc := *p
+				pc.Version = version
+				if isNewProgram(&pc, pc.Name, seen) {
+					programs = append(programs, &pc)
+				}
+			}
+			n = len(programs)
+			if ext == ".vm5" {
+				lib = &voice.VM5VoiceLib{Programs: programs}
+			} else {
+				lib = &voice.VM3VoiceLib{Programs: programs}
+			}
+		case ".vma":
+			if 0 < len(vm35) {
+				log.Warnf("Skipping %d VM3/VM5 voices, which cannot be converted into VMA format", len(vm35))
+			}
+			programs := []*voice.VMAVoicePC{}
+			for _, p := range vma {
+				if isNewProgram(p, p.Name, seen) {
+					programs = append(programs, p)
+				}
+			}
+			n = len(programs)
+			lib = &voice.VMAVoiceLib{Programs: programs}
+		default:
+			return cli.NewExitError(fmt.Errorf("Unknown file extension of output: %s", output), 1)
+		}
+		err := lib.Save(output)
+		if err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		log.Infof("%d voices written to %s", n, output)
+		return nil
+	},
+}
+
+// collectVoices returns the programs in a SMAF format file or a voice library
+func collectVoices(file string) ([]*voice.VM35VoicePC, []*voice.VMAVoicePC, error) {
+	vm35 := []*voice.VM35VoicePC{}
+	vma := []*voice.VMAVoicePC{}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".mmf", ".spf":
+		fc, err := chunk.NewFileChunk(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, x := range fc.CollectExclusives().Exclusives {
+			if x.VM35VoicePC != nil {
+				p := *x.VM35VoicePC
+				// Exclusives do not have the flag which the voice libraries have
+				p.Flag = 0x24
+				p.VoiceType = x.VoiceType
+				vm35 = append(vm35, &p)
+			}
+			if x.VMAVoicePC != nil {
+				vma = append(vma, x.VMAVoicePC)
+			}
+		}
+	case ".vm5":
+		lib, err := voice.NewVM5VoiceLib(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		vm35 = lib.Programs
+	case ".vm3":
+		lib, err := voice.NewVM3VoiceLib(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		vm35 = lib.Programs
+	case ".vma":
+		lib, err := voice.NewVMAVoiceLib(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		vma = lib.Programs
+	default:
+		return nil, nil, fmt.Errorf("Unknown file extension: %s", file)
+	}
+	log.Infof("%d voices found in %s", len(vm35)+len(vma), file)
+	return vm35, vma, nil
+}
+
+// isNewProgram returns false if the same program has been seen, since songs often share the voices
+func isNewProgram(p interface {
+	Write(w io.Writer) error
+}, name string, seen map[string]bool) bool {
+	var b bytes.Buffer
+	if err := p.Write(&b); err != nil {
+		log.Warnf("Skipping a voice: %s", err.Error())
+		return false
+	}
+	key := name + "\x00" + b.String()
+	if seen[key] {
+		return false
+	}
+	seen[key] = true
+	return true
+}
@@ -0,0 +1,68 @@
+//go:build !windows
+// +build !windows
+
+package terminal
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// MakeRaw disables line buffering and echo of the terminal, and returns a function to restore them
+func MakeRaw() (func(), error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, errors.Wrap(err, "Standard input is not a terminal")
+	}
+	_, err = stty("-icanon", "-echo", "min", "1")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return func() {
+		stty(saved)
+	}, nil
+}
+
+// NewInput returns a reader of the standard input, and a function which makes its blocked Read return io.EOF.
+// The reader reads a duplicate of the descriptor in non-blocking mode, so that closing it wakes up Read
+func NewInput() (io.Reader, func(), error) {
+	fd, err := syscall.Dup(int(os.Stdin.Fd()))
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, nil, errors.WithStack(err)
+	}
+	f := os.NewFile(uintptr(fd), "stdin")
+	return eofReader{f}, func() {
+		f.Close()
+		// The mode is shared with the standard input
+		syscall.SetNonblock(int(os.Stdin.Fd()), false)
+	}, nil
+}
+
+// eofReader reports any error as io.EOF, e.g. reading a closed file
+type eofReader struct {
+	r io.Reader
+}
+
+func (e eofReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,86 @@
+package terminal
+
+import (
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	enableEchoInput            = 0x0004
+	enableLineInput            = 0x0002
+	enableVirtualTerminalInput = 0x0200
+)
+
+var (
+	kernel32           = syscall.NewLazyDLL("kernel32.dll")
+	procGetConsoleMode = kernel32.NewProc("GetConsoleMode")
+	procSetConsoleMode = kernel32.NewProc("SetConsoleMode")
+)
+
+func setConsoleMode(h syscall.Handle, mode uint32) error {
+	r, _, err := procSetConsoleMode.Call(uintptr(h), uintptr(mode))
+	if r == 0 {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// MakeRaw disables line buffering and echo of the terminal, and returns a function to restore them
+func MakeRaw() (func(), error) {
+	h := syscall.Handle(os.Stdin.Fd())
+	var saved uint32
+	r, _, err := procGetConsoleMode.Call(uintptr(h), uintptr(unsafe.Pointer(&saved)))
+	if r == 0 {
+		return nil, errors.Wrap(err, "Standard input is not a console")
+	}
+	mode := saved&^(enableEchoInput|enableLineInput) | enableVirtualTerminalInput
+	if err := setConsoleMode(h, mode); err != nil {
+		return nil, err
+	}
+	return func() {
+		setConsoleMode(h, saved)
+	}, nil
+}
+
+// waitInterval is how often the reader returned by NewInput checks if it is canceled
+const waitInterval = 50
+
+// NewInput returns a reader of the standard input, and a function which makes its blocked Read return io.EOF.
+// The reader waits for the console input with a timeout, so that it notices the cancel
+func NewInput() (io.Reader, func(), error) {
+	r := &consoleReader{
+		h:    syscall.Handle(os.Stdin.Fd()),
+		done: make(chan struct{}),
+	}
+	var once sync.Once
+	return r, func() {
+		once.Do(func() { close(r.done) })
+	}, nil
+}
+
+type consoleReader struct {
+	h    syscall.Handle
+	done chan struct{}
+}
+
+func (r *consoleReader) Read(p []byte) (int, error) {
+	for {
+		select {
+		case <-r.done:
+			return 0, io.EOF
+		default:
+		}
+		ev, err := syscall.WaitForSingleObject(r.h, waitInterval)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		if ev == syscall.WAIT_OBJECT_0 {
+			return os.Stdin.Read(p)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package terminal
+
+import (
+	"bufio"
+	"io"
+)
+
+type Key rune
+
+const (
+	Key_Up Key = -1 - iota
+	Key_Down
+	Key_Right
+	Key_Left
+)
+
+// ReadKeys reads key strokes from the terminal in raw mode until EOF
+func ReadKeys(rdr io.Reader) <-chan Key {
+	keys := make(chan Key)
+	go func() {
+		defer close(keys)
+		r := bufio.NewReader(rdr)
+		for {
+			c, _, err := r.ReadRune()
+			if err != nil {
+				return
+			}
+			if c != 0x1B {
+				keys <- Key(c)
+				continue
+			}
+			// Escape sequences of cursor keys: ESC [ A..D or ESC O A..D
+			if r.Buffered() < 2 {
+				keys <- Key(c)
+				continue
+			}
+			b, _ := r.ReadByte()
+			if b != '[' && b != 'O' {
+				keys <- Key(c)
+				r.UnreadByte()
+				continue
+			}
+			b, _ = r.ReadByte()
+			switch b {
+			case 'A':
+				keys <- Key_Up
+			case 'B':
+				keys <- Key_Down
+			case 'C':
+				keys <- Key_Right
+			case 'D':
+				keys <- Key_Left
+			}
+		}
+	}()
+	return keys
+}
@@ -0,0 +1,47 @@
+package ymf825
+
+var (
+	fnumField  = Field{"FNUM", 0, 10}
+	blockField = Field{"BLOCK", 0, 3}
+	intField   = Field{"INT", 0, 2}
+	fracField  = Field{"FRAC", 0, 9}
+)
+
+// CheckFnum returns an error if FNUM or BLOCK is out of range, which PackFnum would drop silently
+func CheckFnum(fnum, block int) error {
+	if err := fnumField.Check(fnum); err != nil {
+		return err
+	}
+	return blockField.Check(block)
+}
+
+// CheckFineTune returns an error if INT or FRAC is out of range, which PackFineTune would drop silently
+func CheckFineTune(INT, FRAC int) error {
+	if err := intField.Check(INT); err != nil {
+		return err
+	}
+	return fracField.Check(FRAC)
+}
+
+// PackFnum returns the values of FnumHigh and FnumLow
+func PackFnum(fnum, block int) (hi, lo byte) {
+	return FnumHigh.Pack(fnum>>7, block), FnumLow.Pack(fnum)
+}
+
+// UnpackFnum returns FNUM and BLOCK in the values of FnumHigh and FnumLow
+func UnpackFnum(hi, lo byte) (fnum, block int) {
+	v := FnumHigh.Unpack(hi)
+	return v[0]<<7 | FnumLow.Unpack(lo)[0], v[1]
+}
+
+// PackFineTune returns the values of FineTuneHigh and FineTuneLow.
+// The frequency is multiplied by INT+FRAC/512
+func PackFineTune(INT, FRAC int) (hi, lo byte) {
+	return FineTuneHigh.Pack(INT, FRAC>>6), FineTuneLow.Pack(FRAC)
+}
+
+// UnpackFineTune returns INT and FRAC in the values of FineTuneHigh and FineTuneLow
+func UnpackFineTune(hi, lo byte) (INT, FRAC int) {
+	v := FineTuneHigh.Unpack(hi)
+	return v[0], v[1]<<6 | FineTuneLow.Unpack(lo)[0]
+}
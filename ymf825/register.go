@@ -0,0 +1,115 @@
+// Package ymf825 defines the registers of YMF825 and packs their fields.
+//
+// https://github.com/yamaha-webmusic/ymf825board/blob/master/manual/fbd_spec2.md
+package ymf825
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Access is the direction in which a register can be accessed
+type Access int
+
+const (
+	Write Access = 1 << iota
+	Read
+	ReadWrite = Write | Read
+)
+
+// Field is a bit field of a register
+type Field struct {
+	Name  string
+	Shift uint
+	Width uint
+}
+
+// Max returns the largest value of the field
+func (f Field) Max() int {
+	return 1<<f.Width - 1
+}
+
+// Check returns an error if v is out of the range of the field
+func (f Field) Check(v int) error {
+	if v < 0 || f.Max() < v {
+		return fmt.Errorf("%s must be 0..%d, got %d", f.Name, f.Max(), v)
+	}
+	return nil
+}
+
+// Put returns v placed at the field. Excess bits of v are dropped
+func (f Field) Put(v int) byte {
+	return byte((v & f.Max()) << f.Shift)
+}
+
+// Get returns the value of the field in b
+func (f Field) Get(b byte) int {
+	return int(b) >> f.Shift & f.Max()
+}
+
+// Register is the definition of a register
+type Register struct {
+	Addr     uint8
+	Name     string
+	Access   Access
+	PerVoice bool // the register is switched by VoiceSelect
+	Burst    bool // the register receives a sequence of bytes
+	Reset    byte // value after reset, given for the registers of voices, VoiceSelect and the reserved registers
+	Reserved bool // the datasheet reserves the register, which must be left at Reset
+	Fields   []Field
+}
+
+// Pack returns the byte made of the values of the fields in the order of Fields. Excess bits are dropped
+func (r *Register) Pack(values ...int) byte {
+	var b byte
+	for i, f := range r.Fields {
+		if i < len(values) {
+			b |= f.Put(values[i])
+		}
+	}
+	return b
+}
+
+// Check returns an error if any of the values is out of the range of the field
+func (r *Register) Check(values ...int) error {
+	if len(values) != len(r.Fields) {
+		return fmt.Errorf("#%d %s has %d fields, got %d values", r.Addr, r.Name, len(r.Fields), len(values))
+	}
+	for i, f := range r.Fields {
+		if err := f.Check(values[i]); err != nil {
+			return fmt.Errorf("#%d %s: %s", r.Addr, r.Name, err.Error())
+		}
+	}
+	return nil
+}
+
+// Unpack returns the values of the fields in b
+func (r *Register) Unpack(b byte) []int {
+	result := make([]int, len(r.Fields))
+	for i, f := range r.Fields {
+		result[i] = f.Get(b)
+	}
+	return result
+}
+
+// Field returns the field of the name, or nil if not found
+func (r *Register) Field(name string) *Field {
+	for i := range r.Fields {
+		if r.Fields[i].Name == name {
+			return &r.Fields[i]
+		}
+	}
+	return nil
+}
+
+// Format returns the fields in b as "NAME=value ..."
+func (r *Register) Format(b byte) string {
+	if len(r.Fields) == 0 {
+		return fmt.Sprintf("0x%02X", b)
+	}
+	s := []string{}
+	for _, f := range r.Fields {
+		s = append(s, fmt.Sprintf("%s=%d", f.Name, f.Get(b)))
+	}
+	return strings.Join(s, " ")
+}
@@ -0,0 +1,137 @@
+package ymf825
+
+import "testing"
+
+func TestPackUnpack(t *testing.T) {
+	for addr := 0; addr < 256; addr++ {
+		r := Lookup(uint8(addr))
+		if r == nil || len(r.Fields) == 0 {
+			continue
+		}
+		zeros := make([]int, len(r.Fields))
+		maxes := make([]int, len(r.Fields))
+		var mask byte
+		for i, f := range r.Fields {
+			maxes[i] = f.Max()
+			if mask&f.Put(f.Max()) != 0 {
+				t.Errorf("#%d %s: %s overlaps other fields", r.Addr, r.Name, f.Name)
+			}
+			mask |= f.Put(f.Max())
+		}
+		for _, values := range [][]int{zeros, maxes} {
+			if err := r.Check(values...); err != nil {
+				t.Errorf("#%d %s: %s", r.Addr, r.Name, err.Error())
+			}
+			b := r.Pack(values...)
+			for i, v := range r.Unpack(b) {
+				if v != values[i] {
+					t.Errorf("#%d %s: %s = %d after packing %d", r.Addr, r.Name, r.Fields[i].Name, v, values[i])
+				}
+			}
+		}
+		// Each field alone makes a byte unpacked to the same values
+		for i, f := range r.Fields {
+			values := make([]int, len(r.Fields))
+			values[i] = f.Max()
+			if got := r.Unpack(r.Pack(values...)); got[i] != f.Max() {
+				t.Errorf("#%d %s: %s = %d, want %d", r.Addr, r.Name, f.Name, got[i], f.Max())
+			}
+			values[i] = f.Max() + 1
+			if r.Check(values...) == nil {
+				t.Errorf("#%d %s: %s = %d is not rejected", r.Addr, r.Name, f.Name, values[i])
+			}
+			values[i] = -1
+			if r.Check(values...) == nil {
+				t.Errorf("#%d %s: %s = -1 is not rejected", r.Addr, r.Name, f.Name)
+			}
+		}
+		if r.Check(zeros[1:]...) == nil {
+			t.Errorf("#%d %s: missing values are not rejected", r.Addr, r.Name)
+		}
+	}
+}
+
+func TestRegisterTable(t *testing.T) {
+	for addr := 0; addr < 53; addr++ {
+		if addr == 30 || addr == 31 {
+			continue
+		}
+		r := Lookup(uint8(addr))
+		if r == nil {
+			t.Errorf("#%d is not defined", addr)
+			continue
+		}
+		if int(r.Addr) != addr {
+			t.Errorf("#%d is defined as #%d %s", addr, r.Addr, r.Name)
+		}
+	}
+	for _, r := range []*Register{Reserved5, Reserved6, Reserved21, Reserved22, Reserved28} {
+		if !r.Reserved || r.Reset != 0x00 || len(r.Fields) != 0 {
+			t.Errorf("#%d %s is not a reserved register reset to 0x00", r.Addr, r.Name)
+		}
+	}
+}
+
+func TestAllOff(t *testing.T) {
+	if AllOff != 0xF6 {
+		t.Errorf("AllOff = 0x%02X, want 0xF6", AllOff)
+	}
+}
+
+// TestMagicConstants compares the registers with the expressions which were written by hand before this package
+func TestMagicConstants(t *testing.T) {
+	tests := []struct {
+		name      string
+		got, want byte
+	}{
+		{"VoiceSelect", VoiceSelect.Pack(13), byte(13 & 15)},
+		{"MasterVolume", MasterVolume.Pack(45), byte(45 << 2)},
+		{"AnalogGain", AnalogGain.Pack(3), byte(3)},
+		{"SequencerVolume", SequencerVolume.Pack(27, 0, 0), byte(27 << 3)},
+		{"Vibrato", Vibrato.Pack(5), byte(5 & 7)},
+		{"ChannelVolume", ChannelVolume.Pack(29, 1), byte(29&31<<2 | 1)},
+		{"VoiceVolume", VoiceVolume.Pack(21), byte(21 & 31 << 2)},
+		{"KeyOn", KeyControl.Pack(1, 0, 0, 11), 0x40 | byte(11&15)},
+		{"KeyOff", KeyControl.Pack(0, 0, 0, 11), byte(11 & 15)},
+		{"MuteAndEGReset", KeyControl.Pack(0, 1, 1, 0), 0x30},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = 0x%02X, want 0x%02X", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestPitch(t *testing.T) {
+	for _, fnum := range []int{0, 1, 127, 128, 651, 1023} {
+		for block := 0; block < 8; block++ {
+			hi, lo := PackFnum(fnum, block)
+			if want := byte((fnum>>7&7)<<3 | block&7); hi != want {
+				t.Errorf("FNUM %d BLOCK %d: high = 0x%02X, want 0x%02X", fnum, block, hi, want)
+			}
+			if want := byte(fnum & 127); lo != want {
+				t.Errorf("FNUM %d BLOCK %d: low = 0x%02X, want 0x%02X", fnum, block, lo, want)
+			}
+			if f, b := UnpackFnum(hi, lo); f != fnum || b != block {
+				t.Errorf("FNUM %d BLOCK %d: unpacked %d %d", fnum, block, f, b)
+			}
+		}
+	}
+	for INT := 0; INT < 4; INT++ {
+		for _, FRAC := range []int{0, 1, 63, 64, 256, 511} {
+			hi, lo := PackFineTune(INT, FRAC)
+			if want := byte(INT&3<<3 | FRAC>>6&7); hi != want {
+				t.Errorf("INT %d FRAC %d: high = 0x%02X, want 0x%02X", INT, FRAC, hi, want)
+			}
+			if want := byte(FRAC & 63 << 1); lo != want {
+				t.Errorf("INT %d FRAC %d: low = 0x%02X, want 0x%02X", INT, FRAC, lo, want)
+			}
+			if i, f := UnpackFineTune(hi, lo); i != INT || f != FRAC {
+				t.Errorf("INT %d FRAC %d: unpacked %d %d", INT, FRAC, i, f)
+			}
+		}
+	}
+	if CheckFnum(1024, 0) == nil || CheckFnum(0, 8) == nil || CheckFineTune(4, 0) == nil || CheckFineTune(0, 512) == nil {
+		t.Errorf("out of range pitch is not rejected")
+	}
+}
@@ -0,0 +1,231 @@
+package ymf825
+
+// Registers of the CPU interface. #5, #6, #21, #22 and #28 are reserved and never written by this program
+var (
+	ClockEnable = &Register{Addr: 0, Name: "clock enable", Access: ReadWrite, Fields: []Field{
+		{"CLKE", 0, 1},
+	}}
+
+	Reset = &Register{Addr: 1, Name: "reset", Access: ReadWrite, Fields: []Field{
+		{"ALRST", 7, 1},
+	}}
+
+	AnalogPowerDown = &Register{Addr: 2, Name: "analog block power-down", Access: ReadWrite, Fields: []Field{
+		{"AP", 0, 4},
+	}}
+
+	AnalogGain = &Register{Addr: 3, Name: "analog gain", Access: ReadWrite, Fields: []Field{
+		{"GAIN", 0, 2},
+	}}
+
+	HardwareID = &Register{Addr: 4, Name: "hardware ID", Access: Read}
+
+	Reserved5 = &Register{Addr: 5, Name: "reserved", Access: Write, Reserved: true, Reset: 0x00}
+	Reserved6 = &Register{Addr: 6, Name: "reserved", Access: Write, Reserved: true, Reset: 0x00}
+
+	// ContentsData receives the contents, i.e. the tone parameters and the sequence data
+	ContentsData = &Register{Addr: 7, Name: "contents data", Access: Write, Burst: true}
+
+	// https://github.com/yamaha-webmusic/ymf825board/blob/master/manual/fbd_spec2.md#sequencer-setting
+	SequencerSetting = &Register{Addr: 8, Name: "sequencer setting", Access: ReadWrite, Fields: []Field{
+		{"AllKeyOff", 7, 1},
+		{"AllMute", 6, 1},
+		{"AllEGRst", 5, 1},
+		{"R_FIFOR", 4, 1},
+		{"REP_SQ", 3, 1},
+		{"R_SEQ", 2, 1},
+		{"R_FIFO", 1, 1},
+		{"START", 0, 1},
+	}}
+
+	SequencerVolume = &Register{Addr: 9, Name: "sequencer volume", Access: ReadWrite, Fields: []Field{
+		{"SEQ_Vol", 3, 5},
+		{"DIR_SV", 2, 1},
+		{"SIZE8", 0, 1},
+	}}
+
+	SequenceSize = &Register{Addr: 10, Name: "sequence size", Access: ReadWrite, Fields: []Field{
+		{"SIZE", 0, 8},
+	}}
+
+	// http://madscient.hatenablog.jp/entry/2017/08/13/013913
+	// レジスタ#11の下位4ビットに操作したいチャンネル番号を0～15で書き込むことで、
+	// レジスタ#12～20に対応するチャンネルのControl Registerが現れます。
+	//
+	// |I_ADR|W/R|D7 |D6 |D5 |D4 |D3       |D2       |D1       |D0       |Reset Value|
+	// |#11  |W/R|"0"|"0"|"0"|"0"|CRGD_VNO3|CRGD_VNO2|CRGD_VNO1|CRGD_VNO0|00H        |
+	//
+	// CRGD_VNO
+	//   The CRGD_VNO is used to specify a tone number.
+	//   Reset Conditions
+	//     1. When the power supplies are turned on (power-on reset).
+	//     2. When the hardware reset is applied (RST_N="L").
+	//     3. When the ALRST is set to "1".
+	VoiceSelect = &Register{Addr: 11, Name: "voice select", Access: ReadWrite, Reset: 0x00, Fields: []Field{
+		{"CRGD_VNO", 0, 4},
+	}}
+
+	// https://github.com/yamaha-webmusic/ymf825board/blob/master/manual/fbd_spec2.md#control-register-write-registers
+	//
+	// |I_ADR |W/R|D7 |D6    |D5    |D4    |D3       |D2       |D1       |D0       |Reset Value|
+	// |#12   |W  |"0"|VoVol4|VoVol3|VoVol2|VoVol1   |VoVol0   |"0"      |"0"      |60H        |
+	// |#13   |W  |"0"|"0"   |FNUM9 |FNUM8 |FNUM7    |BLOCK2   |BLOCK1   |BLOCK0   |00H        |
+	// |#14   |W  |"0"|FNUM6 |FNUM5 |FNUM4 |FNUM3    |FNUM2    |FNUM1    |FNUM0    |00H        |
+	// |#15   |W  |"0"|KeyOn |Mute  |EG_RST|ToneNum3 |ToneNum2 |ToneNum1 |ToneNum0 |00H        |
+	VoiceVolume = &Register{Addr: 12, Name: "voice volume", Access: Write, PerVoice: true, Reset: 0x60, Fields: []Field{
+		{"VoVol", 2, 5},
+	}}
+
+	FnumHigh = &Register{Addr: 13, Name: "FNUM high", Access: Write, PerVoice: true, Reset: 0x00, Fields: []Field{
+		{"FNUM_H", 3, 3},
+		{"BLOCK", 0, 3},
+	}}
+
+	FnumLow = &Register{Addr: 14, Name: "FNUM low", Access: Write, PerVoice: true, Reset: 0x00, Fields: []Field{
+		{"FNUM_L", 0, 7},
+	}}
+
+	// KeyControl takes effect on every write even if the value does not change
+	KeyControl = &Register{Addr: 15, Name: "key control", Access: Write, PerVoice: true, Reset: 0x00, Fields: []Field{
+		{"KeyOn", 6, 1},
+		{"Mute", 5, 1},
+		{"EG_RST", 4, 1},
+		{"ToneNum", 0, 4},
+	}}
+
+	// |I_ADR|W/R|D7 |D6    |D5    |D4    |D3    |D2    |D1 |D0    |Reset Value|
+	// |#16  |W  |"0"|ChVol4|ChVol3|ChVol2|ChVol1|ChVol0|"0"|DIR_CV|60H        |
+	//
+	// ChVol
+	//   This volume setting register is provided for each voice.
+	//   The interpolation function is provided for this volume setting register.
+	//   The relationship between setting values and volume gain values is the same as that of VoVol and SEQ_Vol. Reset Value is "18H" (-4.4 dB)
+	//
+	// DIR_CV
+	//   The DIR_CV controls the interpolation of the SEQ_Vol and ChVol.
+	//   This register is provided for each voice.
+	//   DIR_CV="1":
+	//     No interpolation in the SEQ_Vol and the ChVol# regardless of the DIR_SV and CHVOL_ITIME settings.
+	//   DIR_CV# = "0" (reset value):
+	//     The interpolation depends on the DIR_SV and CHVOL_ITIME settings.
+	ChannelVolume = &Register{Addr: 16, Name: "channel volume", Access: Write, PerVoice: true, Reset: 0x60, Fields: []Field{
+		{"ChVol", 2, 5},
+		{"DIR_CV", 0, 1},
+	}}
+
+	// |I_ADR|W/R|D7 |D6    |D5    |D4    |D3    |D2    |D1   |D0    |Reset Value|
+	// |#17  |W  |"0"|"0"   |"0"   |"0"   |"0"   |XVB2  |XVB1 |XVB0  |00H        |
+	//
+	// XVB
+	//   The XVB is used to set a vibrato modulation.
+	//   This register is provided for each voice.
+	//   A setting value relatively acts on a DVB setting value of the voice parameter, as shown below.
+	//   When the calculation (add) result exceeds "3", "3"is used for the processing.
+	//     "0": OFF (reset value)
+	//     "1": 1 x (DVB value is used as is.)
+	//     "2": 2 x (DVB += 1)
+	//     "3": 2 x (DVB += 1)
+	//     "4": 4 x (DVB += 2)
+	//     "5": 4 x (DVB += 2)
+	//     "6": 8 x (DVB += 3)
+	//     "7": 8 x (DVB += 3)
+	Vibrato = &Register{Addr: 17, Name: "vibrato", Access: Write, PerVoice: true, Reset: 0x00, Fields: []Field{
+		{"XVB", 0, 3},
+	}}
+
+	// |I_ADR|W/R|D7 |D6   |D5   |D4   |D3   |D2   |D1   |D0   |Reset Value|
+	// |#18  |W  |"0"|"0"  |"0"  |INT1 |INT0 |FRAC8|FRAC7|FRAC6|08H        |
+	// |#19  |W  |"0"|FRAC5|FRAC4|FRAC3|FRAC2|FRAC1|FRAC0|"0"  |00H        |
+	//
+	// INT, FRAC
+	//   These registers specify a multiplier to the generated audio frequency. This number and frequency are proportional.
+	//   The INT is an integer part and FRAC is a fraction part.
+	//   These registers are provided for each voice.
+	//   Reset Value
+	//     INT : "01H"
+	//     FRAC: "000H"
+	FineTuneHigh = &Register{Addr: 18, Name: "fine tune high", Access: Write, PerVoice: true, Reset: 0x08, Fields: []Field{
+		{"INT", 3, 2},
+		{"FRAC_H", 0, 3},
+	}}
+
+	FineTuneLow = &Register{Addr: 19, Name: "fine tune low", Access: Write, PerVoice: true, Reset: 0x00, Fields: []Field{
+		{"FRAC_L", 1, 6},
+	}}
+
+	MuteInterpolation = &Register{Addr: 20, Name: "mute interpolation", Access: ReadWrite, Fields: []Field{
+		{"DIR_MT", 0, 1},
+	}}
+
+	Reserved21 = &Register{Addr: 21, Name: "reserved", Access: Write, Reserved: true, Reset: 0x00}
+	Reserved22 = &Register{Addr: 22, Name: "reserved", Access: Write, Reserved: true, Reset: 0x00}
+
+	SequencerTimeUnitHigh = &Register{Addr: 23, Name: "sequencer time unit high", Access: ReadWrite, Fields: []Field{
+		{"MS_S_H", 0, 7},
+	}}
+
+	SequencerTimeUnitLow = &Register{Addr: 24, Name: "sequencer time unit low", Access: ReadWrite, Fields: []Field{
+		{"MS_S_L", 0, 7},
+	}}
+
+	MasterVolume = &Register{Addr: 25, Name: "master volume", Access: ReadWrite, Fields: []Field{
+		{"MASTER_VOL", 2, 6},
+	}}
+
+	// SoftReset resets the registers except the CPU interface by writing SoftResetValue
+	SoftReset = &Register{Addr: 26, Name: "soft reset", Access: ReadWrite, Fields: []Field{
+		{"SFTRST", 0, 8},
+	}}
+
+	Interpolation = &Register{Addr: 27, Name: "interpolation time", Access: ReadWrite, Fields: []Field{
+		{"MUTE_ITIME", 4, 2},
+		{"CHVOL_ITIME", 2, 2},
+		{"MVOL_ITIME", 0, 2},
+	}}
+
+	Reserved28 = &Register{Addr: 28, Name: "reserved", Access: Write, Reserved: true, Reset: 0x00}
+
+	PowerRail = &Register{Addr: 29, Name: "power rail selection", Access: ReadWrite, Fields: []Field{
+		{"DRV_SEL", 0, 1},
+	}}
+
+	EqualizerWrite0 = &Register{Addr: 32, Name: "equalizer 0", Access: Write, Burst: true}
+	EqualizerWrite1 = &Register{Addr: 33, Name: "equalizer 1", Access: Write, Burst: true}
+	EqualizerWrite2 = &Register{Addr: 34, Name: "equalizer 2", Access: Write, Burst: true}
+)
+
+// SoftResetValue is the value written to SoftReset to start the reset
+const SoftResetValue = 0xA3
+
+// AllOff is the value of SequencerSetting which stops all voices and clears the sequencer
+var AllOff = SequencerSetting.Pack(1, 1, 1, 1, 0, 1, 1, 0)
+
+var registers = map[uint8]*Register{}
+
+func init() {
+	for _, r := range []*Register{
+		ClockEnable, Reset, AnalogPowerDown, AnalogGain, HardwareID, Reserved5, Reserved6, ContentsData,
+		SequencerSetting, SequencerVolume, SequenceSize, VoiceSelect,
+		VoiceVolume, FnumHigh, FnumLow, KeyControl, ChannelVolume, Vibrato, FineTuneHigh, FineTuneLow,
+		MuteInterpolation, Reserved21, Reserved22, SequencerTimeUnitHigh, SequencerTimeUnitLow,
+		MasterVolume, SoftReset, Interpolation, Reserved28, PowerRail,
+		EqualizerWrite0, EqualizerWrite1, EqualizerWrite2,
+	} {
+		registers[r.Addr] = r
+	}
+	// #35..#52 read back the coefficients of the equalizer
+	for i := uint8(0); i < 18; i++ {
+		registers[35+i] = &Register{Addr: 35 + i, Name: "equalizer coefficient", Access: Read}
+	}
+}
+
+// Lookup returns the definition of the register, or nil if it is not defined
+func Lookup(addr uint8) *Register {
+	return registers[addr]
+}
+
+// IsPerVoice returns true if the register is switched by VoiceSelect
+func IsPerVoice(addr uint8) bool {
+	r := Lookup(addr)
+	return r != nil && r.PerVoice
+}